@@ -1,13 +1,16 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"regexp"
 	"runtime/debug"
+	"strconv"
 	"strings"
+	"sync/atomic"
 
 	"stash-plugin-duplicate-finder/internal/plugin/common"
 	"stash-plugin-duplicate-finder/internal/plugin/common/log"
@@ -19,12 +22,60 @@ import (
 
 const spriteSuffix = "_sprite.jpg"
 
+// Hook types handled by the plugin
+const (
+	hookSceneCreatePost = "Scene.Create.Post"
+	hookSceneUpdatePost = "Scene.Update.Post"
+)
+
 type api struct {
-	stopping       bool
+	// stopping is set to 1 by stop, which may be called from another
+	// goroutine than the one doing the work
+	stopping int32
+
 	cfg            config
 	client         *graphql.Client
 	cache          *sceneCache
 	duplicateTagID *graphql.ID
+	markerTagID    *graphql.ID
+	decisions      decisions
+
+	// serverURL is the base URL of the stash server
+	serverURL string
+
+	// failures contains the calls to the server that failed after retrying
+	failures []string
+
+	// notFound contains the sprites that do not match any scene on the server
+	notFound []string
+
+	// mirrored contains the keys of the pairs matched using the mirrored
+	// hash of the subject
+	mirrored map[string]bool
+
+	// meta contains the details detected when hashing the sprites
+	meta spriteMetas
+
+	// intros are the known intros excluded from hashing
+	intros []knownIntro
+
+	// segments contains the matching segments of the pairs aligned in this
+	// run, keyed by subject and other sprite names separated by |
+	segments map[string][]matchSegment
+
+	// partial contains the keys of the pairs matched in this run whose
+	// durations differ too much for them to be whole scene duplicates
+	partial map[string]bool
+
+	// durationScores contains the scores of the pairs matched in this run
+	// scaled by the ratio of their durations, keyed by pair. It is 0 for
+	// pairs whose scores were not scaled.
+	durationScores map[string]float64
+
+	// hook is true when checking the scene that triggered a hook. Only the
+	// markers of that scene and its duplicates are synced, and the export
+	// file is not written.
+	hook bool
 }
 
 func main() {
@@ -43,11 +94,21 @@ func main() {
 
 func (a *api) Stop(input struct{}, output *bool) error {
 	log.Info("Stopping...")
-	a.stopping = true
+	a.stop()
 	*output = true
 	return nil
 }
 
+// stop requests that the current task stops after the current item.
+func (a *api) stop() {
+	atomic.StoreInt32(&a.stopping, 1)
+}
+
+// isStopping returns true if stop has been called.
+func (a *api) isStopping() bool {
+	return atomic.LoadInt32(&a.stopping) != 0
+}
+
 // Run is the main work function of the plugin. It interprets the input and
 // acts accordingly.
 func (a *api) Run(input common.PluginInput, output *common.PluginOutput) error {
@@ -87,6 +148,30 @@ func (a *api) runImpl(input common.PluginInput) (err error) {
 	if !filepath.IsAbs(a.cfg.DBFilename) {
 		a.cfg.DBFilename = filepath.Join(pluginDir, a.cfg.DBFilename)
 	}
+	if !filepath.IsAbs(a.cfg.MatchesFilename) {
+		a.cfg.MatchesFilename = filepath.Join(pluginDir, a.cfg.MatchesFilename)
+	}
+	if !filepath.IsAbs(a.cfg.DecisionsFilename) {
+		a.cfg.DecisionsFilename = filepath.Join(pluginDir, a.cfg.DecisionsFilename)
+	}
+	if !filepath.IsAbs(a.cfg.MetaFilename) {
+		a.cfg.MetaFilename = filepath.Join(pluginDir, a.cfg.MetaFilename)
+	}
+	if !filepath.IsAbs(a.cfg.IntrosFilename) {
+		a.cfg.IntrosFilename = filepath.Join(pluginDir, a.cfg.IntrosFilename)
+	}
+	if !filepath.IsAbs(a.cfg.ImagesDBFilename) {
+		a.cfg.ImagesDBFilename = filepath.Join(pluginDir, a.cfg.ImagesDBFilename)
+	}
+	if !filepath.IsAbs(a.cfg.ImageMatchesFilename) {
+		a.cfg.ImageMatchesFilename = filepath.Join(pluginDir, a.cfg.ImageMatchesFilename)
+	}
+	if a.cfg.ExportFilename != "" && !filepath.IsAbs(a.cfg.ExportFilename) {
+		a.cfg.ExportFilename = filepath.Join(pluginDir, a.cfg.ExportFilename)
+	}
+	if !isValidReportFormat(a.cfg.ExportFormat) {
+		return fmt.Errorf("invalid export_format: %s", a.cfg.ExportFormat)
+	}
 
 	// HACK - get the server address from the server config file
 	serverCfg, err := readServerConfig(filepath.Join(input.ServerConnection.Dir, "config.yml"))
@@ -94,25 +179,205 @@ func (a *api) runImpl(input common.PluginInput) (err error) {
 		return fmt.Errorf("error reading server configuration file: %s", err.Error())
 	}
 
-	a.client = util.NewClient(input.ServerConnection, serverCfg.Host)
-	a.cache = newSceneCache(a.client)
+	if a.cfg.CACert != "" && !filepath.IsAbs(a.cfg.CACert) {
+		a.cfg.CACert = filepath.Join(pluginDir, a.cfg.CACert)
+	}
+
+	a.serverURL = fmt.Sprintf("%s://%s:%d", input.ServerConnection.Scheme, serverCfg.Host, input.ServerConnection.Port)
+	a.client, err = util.NewClient(input.ServerConnection, serverCfg.Host, a.cfg.clientOptions())
+	if err != nil {
+		return fmt.Errorf("error creating graphql client: %s", err.Error())
+	}
+
+	if err := a.connect(); err != nil {
+		return err
+	}
 
-	if cfg.AddTagName != "" {
-		tagID, err := getDuplicateTagId(a.client, cfg.AddTagName)
+	if err := a.loadIntros(); err != nil {
+		return err
+	}
+
+	if input.Args.String("mode") == "intros" {
+		path, err := a.getSpriteDir("")
+		if err != nil {
+			return err
+		}
+
+		intros, err := a.detectIntros(path)
+		if err != nil {
+			return err
+		}
+
+		log.Infof("Found %d intros and outros", len(intros))
+		return nil
+	}
+
+	if input.Args.String("mode") == "images" {
+		path, err := a.getSpriteDir("")
+		if err != nil {
+			return err
+		}
+
+		_, _, err = a.findImageDuplicates(filepath.Dir(path))
+		return err
+	}
+
+	if input.Args.String("mode") == "phash" {
+		_, err := a.findPhashDuplicates()
+		return err
+	}
+
+	if input.Args.String("mode") == "markers" {
+		if a.markerTagID == nil {
+			return errors.New("marker_tag_name must be set to sync duplicate markers")
+		}
+
+		err := a.syncStoredMarkers(nil)
+		a.logFailures()
+		return err
+	}
+
+	if hc := input.Args.ToHookContext(); hc != nil {
+		return a.runHook(hc)
+	}
+
+	// the scene argument may be provided as a string or a number
+	scene := input.Args.String("scene")
+	if v := input.Args.Float("scene"); scene == "" && v > 0 {
+		scene = strconv.FormatFloat(v, 'f', -1, 64)
+	}
+
+	if scene != "" {
+		return a.findSceneDuplicates("", scene, nil)
+	}
+
+	if input.Args.String("mode") == "query" {
+		return errors.New("the scene argument is required to query a single scene")
+	}
+
+	return a.findDuplicates("", nil, nil)
+}
+
+// connect queries the server for the details needed to handle duplicates,
+// using the existing client.
+func (a *api) connect() error {
+	algorithm, err := getVideoFileNamingAlgorithm(a.client)
+	if err != nil {
+		log.Warnf("%s. Assuming %s.", err.Error(), hashAlgorithmMD5)
+		algorithm = hashAlgorithmMD5
+	}
+	log.Debugf("Video file naming algorithm is: %s", algorithm)
+
+	a.cache = newSceneCache(a.client, algorithm)
+
+	if a.cfg.AddTagName != "" {
+		tagID, err := getDuplicateTagId(a.client, a.cfg.AddTagName)
 		if err != nil {
 			return err
 		}
 
 		if tagID == nil {
-			return fmt.Errorf("could not find tag with name %s", cfg.AddTagName)
+			return fmt.Errorf("could not find tag with name %s", a.cfg.AddTagName)
 		}
 
 		a.duplicateTagID = tagID
 		log.Debugf("Duplicate tag id = %v", *a.duplicateTagID)
 	}
 
-	// find where the generated sprite files are stored
-	path, err := getSpriteDir(a.client)
+	if a.cfg.MarkerTagName != "" {
+		tagID, err := getDuplicateTagId(a.client, a.cfg.MarkerTagName)
+		if err != nil {
+			return err
+		}
+
+		if tagID == nil {
+			return fmt.Errorf("could not find tag with name %s", a.cfg.MarkerTagName)
+		}
+
+		a.markerTagID = tagID
+		log.Debugf("Marker tag id = %v", *a.markerTagID)
+	}
+
+	return nil
+}
+
+// runHook checks the scene that triggered the hook for duplicates. Only
+// scenes with a sprite that has not been processed are checked. This prevents
+// the hook from processing scenes again when they are updated by the plugin.
+func (a *api) runHook(hc *common.HookContext) error {
+	switch hc.Type {
+	case hookSceneCreatePost, hookSceneUpdatePost:
+	default:
+		return fmt.Errorf("unsupported hook type: %s", hc.Type)
+	}
+
+	a.cfg.NewOnly = true
+	a.hook = true
+
+	// only the scene and its duplicates are looked up, so prefetching all
+	// scenes is not worth it
+	a.cache.disablePrefetch()
+
+	path, err := a.getSpriteDir("")
+	if err != nil {
+		return err
+	}
+
+	id := strconv.Itoa(hc.ID)
+	s, err := findSceneFromID(a.client, id)
+	if err != nil {
+		return err
+	}
+
+	if s == nil {
+		log.Debugf("Not checking scene %s: scene not found", id)
+		return nil
+	}
+	a.cache.add(s)
+
+	// sprites are generated after the scene is created, so the scene may not
+	// have a sprite yet
+	fn, err := a.sceneSprite(path, s)
+	if err != nil {
+		log.Debugf("Not checking scene %s: %s", id, err.Error())
+		return nil
+	}
+
+	// the sprite is skipped if it has already been processed, as NewOnly is
+	// set
+	log.Debugf("Checking scene %s for duplicates", id)
+	return a.findDuplicates(path, []string{filepath.Base(fn)}, nil)
+}
+
+// findSceneDuplicates processes the sprite of a single scene, logging and
+// handling any duplicates found in the existing database. scene may be a
+// sprite filename, the checksum or oshash of the scene, or the scene id. If
+// path is empty, then the sprite directory is queried from the server.
+func (a *api) findSceneDuplicates(path string, scene string, extra handleDuplicatesFunc) error {
+	path, err := a.getSpriteDir(path)
+	if err != nil {
+		return err
+	}
+
+	fn, err := a.resolveSprite(path, scene)
+	if err != nil {
+		return err
+	}
+
+	// the scene is usually already in the database, and would be skipped
+	a.cfg.NewOnly = false
+
+	log.Infof("Finding duplicates of %s", getChecksum(fn))
+	return a.findDuplicates(filepath.Dir(fn), []string{filepath.Base(fn)}, extra)
+}
+
+// findDuplicates processes the sprite files in path, logging and handling any
+// duplicates found. If names is not nil, then only the named files are
+// processed. If path is empty, then the sprite directory is queried from the
+// server. If extra is not nil, then it is also called for each processed
+// file.
+func (a *api) findDuplicates(path string, names []string, extra handleDuplicatesFunc) error {
+	path, err := a.getSpriteDir(path)
 	if err != nil {
 		return err
 	}
@@ -121,131 +386,524 @@ func (a *api) runImpl(input common.PluginInput) (err error) {
 
 	log.Info("Processing files for perceptual hashes...")
 	m := make(matchInfoMap)
-	foundDupes := 0
+	var foundDupes []string
 
 	hdFunc := func(checksum string, matches duplo.Matches) {
+		if extra != nil {
+			extra(checksum, matches)
+		}
+
 		if len(matches) > 0 {
-			foundDupes++
+			foundDupes = append(foundDupes, checksum)
 			for _, match := range matches {
-				m.add(checksum, match.ID.(string), match.Score)
+				id := match.ID.(string)
+				m.add(checksum, id, match.Score, a.mirrored[pairKey(checksum, id)], a.partial[pairKey(checksum, id)])
 				a.logDuplicate(checksum, match)
 				a.handleDuplicate(m, checksum, true)
 			}
 		}
 	}
 
-	err = a.processFiles(path, hdFunc)
+	err = a.processFiles(path, names, hdFunc)
 	if err != nil {
 		return err
 	}
 
-	log.Infof("Found %d duplicate scenes", foundDupes)
+	log.Infof("Found %d duplicate scenes", len(foundDupes))
+
+	// a hook only changes the markers of the scene and its duplicates
+	var only []string
+	if a.hook {
+		only = foundDupes
+	}
+
+	if a.markerTagID != nil && !a.isStopping() && (!a.hook || len(only) > 0) {
+		if err := a.syncStoredMarkers(only); err != nil {
+			a.addFailure("%s", err.Error())
+		}
+	}
+
+	if a.cfg.ExportFilename != "" && !a.hook {
+		if err := a.writeExport(path); err != nil {
+			log.Errorf("Error writing export file: %s", err.Error())
+		}
+	}
+
+	a.logFailures()
 	return nil
 }
 
+// getSpriteDir returns path if it is not empty, otherwise it queries the
+// server for the directory where the generated sprite files are stored.
+func (a *api) getSpriteDir(path string) (string, error) {
+	if path != "" {
+		return path, nil
+	}
+
+	return getSpriteDir(a.client)
+}
+
+// resolveSprite returns the sprite filename for the argument, which may be a
+// sprite filename, a sprite name in path or, when connected to a server, the
+// checksum, oshash or id of a scene.
+func (a *api) resolveSprite(path, arg string) (string, error) {
+	if _, err := os.Stat(arg); err == nil {
+		return arg, nil
+	}
+
+	if path != "" {
+		fn := getSpriteFilename(path, arg)
+		if _, err := os.Stat(fn); err == nil {
+			return fn, nil
+		}
+	}
+
+	if a.cache == nil {
+		return "", fmt.Errorf("%s is not a sprite file or sprite name", arg)
+	}
+
+	// the sprite may be named using the other hash of the scene
+	get := a.cache.get
+	if _, err := strconv.Atoi(arg); err == nil {
+		get = a.cache.getByID
+	}
+
+	s, err := get(arg)
+	if err != nil {
+		return "", err
+	}
+
+	return a.sceneSprite(path, s)
+}
+
+// sceneSprite returns the sprite filename of the scene in path.
+func (a *api) sceneSprite(path string, s *Scene) (string, error) {
+	// try the current naming algorithm first
+	hashes := []string{s.getHash(a.cache.algorithm), s.getHash(hashAlgorithmMD5), s.getHash(hashAlgorithmOshash)}
+	for _, h := range hashes {
+		fn := getSpriteFilename(path, h)
+		if _, err := os.Stat(fn); h != "" && err == nil {
+			return fn, nil
+		}
+	}
+
+	return "", fmt.Errorf("no sprite file found for scene %s", s.ID)
+}
+
+// writeExport writes all matches in the matches file to the configured
+// export file.
+func (a *api) writeExport(spriteDir string) error {
+	results, err := readMatches(a.cfg.MatchesFilename)
+	if err != nil {
+		return err
+	}
+
+	r := report{
+		results:   results,
+		cache:     a.cache,
+		spriteDir: spriteDir,
+		serverURL: a.serverURL,
+		decisions: a.decisions,
+	}
+
+	log.Infof("Writing %d matches to %s", len(results), a.cfg.ExportFilename)
+	return r.writeFile(a.cfg.ExportFilename, a.cfg.ExportFormat)
+}
+
+// addFailure logs an error for a call to the server that failed permanently,
+// and records it for the summary at the end of the run.
+func (a *api) addFailure(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	log.Error(msg)
+	a.failures = append(a.failures, msg)
+}
+
+// addSceneError records an error getting the scene of the sprite. Sprites
+// without a scene are not counted as failed calls to the server.
+func (a *api) addSceneError(name string, err error) {
+	if _, ok := err.(sceneNotFoundError); !ok {
+		a.addFailure("error getting scene with checksum %s: %s", name, err.Error())
+		return
+	}
+
+	for _, n := range a.notFound {
+		if n == name {
+			return
+		}
+	}
+
+	log.Warnf("No scene found for sprite %s", name)
+	a.notFound = append(a.notFound, name)
+}
+
+func (a *api) logFailures() {
+	if len(a.notFound) > 0 {
+		log.Warnf("%d sprites do not match any scene: %s", len(a.notFound), strings.Join(a.notFound, ", "))
+	}
+
+	if len(a.failures) == 0 {
+		return
+	}
+
+	log.Warnf("%d calls to the server failed:", len(a.failures))
+	for _, f := range a.failures {
+		log.Warn(f)
+	}
+}
+
 type handleDuplicatesFunc func(checksum string, matches duplo.Matches)
 
-func (a *api) processFiles(path string, hdFunc handleDuplicatesFunc) error {
-	files, err := ioutil.ReadDir(path)
+// hashResult is the result of hashing a sprite file. hash is nil if the file
+// was skipped.
+type hashResult struct {
+	fn     string
+	index  int
+	hashes *spriteHashes
+	err    error
+}
+
+// processFiles hashes the named sprite files in path, or all files in path if
+// names is nil, and processes the hashes against the database.
+func (a *api) processFiles(path string, names []string, hdFunc handleDuplicatesFunc) error {
+	if names == nil {
+		files, err := ioutil.ReadDir(path)
+		if err != nil {
+			return err
+		}
+
+		for _, f := range files {
+			names = append(names, f.Name())
+		}
+	}
+
+	lock, err := a.lockDB()
 	if err != nil {
 		return err
 	}
+	defer lock.release()
 
 	// read the store
 	store := duplo.New()
 	readDB(store, a.cfg.DBFilename)
-	total := len(files)
+	matches, err := readMatches(a.cfg.MatchesFilename)
+	if err != nil {
+		log.Warnf("Error reading matches file: %s", err.Error())
+	}
+	a.decisions, err = readDecisions(a.cfg.DecisionsFilename)
+	if err != nil {
+		return fmt.Errorf("error reading decisions file: %s", err.Error())
+	}
+	a.meta, err = readMeta(a.cfg.MetaFilename)
+	if err != nil {
+		return fmt.Errorf("error reading meta file: %s", err.Error())
+	}
+	total := len(names)
+	processed := 0
 
-	for i, f := range files {
-		if a.stopping {
-			break
-		}
+	for r := range a.hashFiles(path, names, store) {
+		result := <-r
+		log.Progress(float64(result.index) / float64(total))
 
-		log.Progress(float64(i) / float64(total))
+		if result.err != nil {
+			log.Errorf("Error processing file %s: %s", filepath.Base(result.fn), result.err.Error())
+			continue
+		}
 
-		fn := filepath.Join(path, f.Name())
-		if err := a.processFile(fn, store, hdFunc); err != nil {
-			log.Errorf("Error processing file %s: %s", f.Name(), err.Error())
+		if result.hashes != nil {
+			processed++
+			checksum := getChecksum(result.fn)
+			fileMatches := a.processHash(result.fn, result.hashes, store, hdFunc)
+			matches = matches.set(checksum, fileMatches, a.mirrored)
+			matches.setSegments(a.segments)
+			matches.setPartial(a.partial)
+			matches.setDurationScores(a.durationScores)
 		}
 	}
 
+	if processed == 0 {
+		// nothing changed, so the files are not written
+		return nil
+	}
+
+	// remove matches with hashes that were removed from the store
+	matches = matches.filter(func(r *matchResult) bool {
+		return store.Has(r.Subject) && store.Has(r.Other)
+	})
+	a.meta.prune(path, store)
+	matches.setAspectRatios(a.meta)
+
 	storeDB(store, a.cfg.DBFilename)
+	if err := storeMatches(matches, a.cfg.MatchesFilename); err != nil {
+		log.Errorf("Error writing matches file: %s", err.Error())
+	}
+	if err := storeMeta(a.meta, a.cfg.MetaFilename); err != nil {
+		log.Errorf("Error writing meta file: %s", err.Error())
+	}
 
 	return nil
 }
 
-func (a *api) processFile(fn string, store *duplo.Store, hdFunc handleDuplicatesFunc) error {
-	if !isSpriteFile(fn) {
-		return nil
+// hashFiles hashes the sprite files using the configured number of workers.
+// The results are returned in the order of the provided files. Each element
+// of the returned channel receives the result for a single file.
+func (a *api) hashFiles(path string, names []string, store *duplo.Store) <-chan chan hashResult {
+	workers := a.cfg.Workers
+	if workers < 1 {
+		workers = 1
+	}
+
+	// low information sprites are not stored, so are identified using the
+	// metadata read before hashing
+	lowInformation := make(map[string]bool)
+	for name, m := range a.meta {
+		lowInformation[name] = m.LowInformation
 	}
 
+	ret := make(chan chan hashResult, workers)
+	go func() {
+		defer close(ret)
+		sem := make(chan struct{}, workers)
+
+		for i, name := range names {
+			if a.isStopping() {
+				break
+			}
+
+			fn := filepath.Join(path, name)
+			if !isSpriteFile(fn) {
+				continue
+			}
+
+			c := make(chan hashResult, 1)
+			ret <- c
+
+			checksum := getChecksum(fn)
+			if (store.Has(checksum) || lowInformation[checksum]) && a.cfg.NewOnly {
+				c <- hashResult{fn: fn, index: i}
+				continue
+			}
+
+			sem <- struct{}{}
+			go func(i int, fn string) {
+				defer func() { <-sem }()
+				o := a.hashOptions(checksum)
+				o.tileHashes = a.needsTileHashes(path, checksum)
+				hashes, err := getImageHashes(fn, o)
+				c <- hashResult{fn: fn, index: i, hashes: hashes, err: err}
+			}(i, fn)
+		}
+	}()
+
+	return ret
+}
+
+// lockDB acquires the lock of the database files, waiting while another run
+// holds it.
+func (a *api) lockDB() (*fileLock, error) {
+	return acquireLock(a.cfg.DBFilename+".lock", a.isStopping)
+}
+
+// processHash queries the store for matches of the provided sprite hashes,
+// calls hdFunc with the matches and adds the hash to the store. It returns
+// the matches passed to hdFunc.
+func (a *api) processHash(fn string, hashes *spriteHashes, store *duplo.Store, hdFunc handleDuplicatesFunc) duplo.Matches {
 	checksum := getChecksum(fn)
-	existing := store.Has(checksum)
-	if existing && a.cfg.NewOnly {
+	path := filepath.Dir(fn)
+	if a.isStaleSprite(path, checksum) {
+		// the scene is processed using its current sprite
+		store.Delete(checksum)
 		return nil
 	}
 
-	hash, err := getImageHash(fn)
-	if err != nil {
-		return err
+	if meta := a.setMeta(checksum, hashes); meta.LowInformation {
+		// matches with low information sprites are meaningless
+		log.Debugf("Excluding %s: only %d informative tiles", checksum, meta.informativeTiles())
+		store.Delete(checksum)
+		return nil
 	}
 
-	matches := getHashMatches(store, checksum, *hash, a.cfg.Threshold)
+	existing := store.Has(checksum)
+	matches := a.queryHash(store, checksum, hashes.hash, hashes.mirroredHash)
 
 	// remove any matches that no longer exist
 	var filteredMatches duplo.Matches
-	path := filepath.Dir(fn)
 	for _, m := range matches {
 		dupeSprite := getSpriteFilename(path, m.ID.(string))
 		if _, err := os.Stat(dupeSprite); os.IsNotExist(err) {
 			store.Delete(m.ID)
-		} else {
+		} else if !a.sameScene(checksum, m.ID.(string)) && !a.decisions.isIgnored(checksum, m.ID.(string)) {
 			filteredMatches = append(filteredMatches, m)
 		}
 	}
 
+	a.alignMatches(path, checksum, hashes, filteredMatches)
+	filteredMatches = a.filterDurations(path, checksum, filteredMatches)
 	hdFunc(checksum, filteredMatches)
 
 	if !existing {
-		store.Add(checksum, *hash)
+		store.Add(checksum, hashes.hash)
+	}
+
+	return filteredMatches
+}
+
+// loadIntros reads the known intros file if intros are excluded.
+func (a *api) loadIntros() error {
+	if !a.cfg.ExcludeIntros {
+		return nil
+	}
+
+	var err error
+	a.intros, err = readIntros(a.cfg.IntrosFilename)
+	if err != nil {
+		return fmt.Errorf("error reading intros file: %s", err.Error())
 	}
 
 	return nil
 }
 
+// hashOptions returns the options used to hash the named sprite, including
+// the masks of the studio of its scene.
+func (a *api) hashOptions(name string) spriteHashOptions {
+	ret := a.cfg.hashOptions()
+	if a.cfg.ExcludeIntros {
+		ret.intros = a.intros
+	}
+
+	if len(a.cfg.StudioMasks) == 0 || a.cache == nil {
+		return ret
+	}
+
+	s, err := a.cache.get(name)
+	if err != nil || s.Studio == nil {
+		return ret
+	}
+
+	if masks := a.cfg.StudioMasks[string(s.Studio.Name)]; len(masks) > 0 {
+		ret.masks = append(append([]maskRect{}, ret.masks...), masks...)
+	}
+
+	return ret
+}
+
+// queryHash returns the matches of the sprite hash in the store. If
+// mirroredHash is not nil, then the matches of the mirrored sprite are
+// included, and the pairs that they match are recorded as mirrored.
+func (a *api) queryHash(store *duplo.Store, checksum string, hash duplo.Hash, mirroredHash *duplo.Hash) duplo.Matches {
+	matches := getHashMatches(store, checksum, hash, a.cfg.matchCriteria)
+	if mirroredHash == nil {
+		return matches
+	}
+
+	matches, mirrored := mergeMirroredMatches(matches, getHashMatches(store, checksum, *mirroredHash, a.cfg.matchCriteria))
+	if a.mirrored == nil {
+		a.mirrored = make(map[string]bool)
+	}
+	for _, m := range matches {
+		id := m.ID.(string)
+		a.mirrored[pairKey(checksum, id)] = mirrored[id]
+	}
+
+	return matches
+}
+
+// sameScene returns true if both sprite names refer to the same scene. This
+// is the case when a scene has sprites named by both its checksum and oshash.
+func (a *api) sameScene(name, other string) bool {
+	if a.cache == nil {
+		return false
+	}
+
+	s, err := a.cache.get(name)
+	if err != nil {
+		return false
+	}
+
+	o, err := a.cache.get(other)
+	if err != nil {
+		return false
+	}
+
+	return s.ID == o.ID
+}
+
+// isStaleSprite returns true if the sprite is not named using the current
+// video file naming algorithm, and the sprite named using the current
+// algorithm exists. This occurs when the naming algorithm has been changed
+// and the old generated files were not removed.
+func (a *api) isStaleSprite(path, name string) bool {
+	if a.cache == nil {
+		return false
+	}
+
+	s, err := a.cache.get(name)
+	if err != nil {
+		return false
+	}
+
+	current := s.getHash(a.cache.algorithm)
+	if current == "" || current == name {
+		return false
+	}
+
+	_, err = os.Stat(getSpriteFilename(path, current))
+	return err == nil
+}
+
 func (a *api) logDuplicate(checksum string, match *duplo.Match) {
 	subject, err := a.cache.get(checksum)
 	if err != nil {
-		log.Errorf("error getting scene with checksum %s: %s", checksum, err.Error())
+		a.addSceneError(checksum, err)
 		return
 	}
 
 	s, err := a.cache.get(match.ID.(string))
 	if err != nil {
-		log.Errorf("error getting scene with checksum %s: %s", match.ID.(string), err.Error())
+		a.addSceneError(match.ID.(string), err)
 		return
 	}
 
-	log.Infof("Duplicate: %s - %s (score: %.f)", subject.ID, s.ID, -match.Score)
+	r := newMatchResult(checksum, match, a.mirrored[pairKey(checksum, match.ID.(string))])
+	matchResults{r}.setAspectRatios(a.meta)
+	matchResults{r}.setSegments(a.segments)
+	matchResults{r}.setPartial(a.partial)
+	matchResults{r}.setDurationScores(a.durationScores)
+	log.Infof("Duplicate: %s - %s (score: %.f%s)", subject.ID, s.ID, -match.Score, r.notes())
 }
 
 func (a *api) handleDuplicate(m matchInfoMap, checksum string, recurse bool) {
 	matches := m[checksum]
 	subject, err := a.cache.get(checksum)
 	if err != nil {
-		log.Errorf("error getting scene with checksum %s: %s", checksum, err.Error())
+		a.addSceneError(checksum, err)
 		return
 	}
 
 	newDetails := "=== Duplicate finder plugin ==="
+	whole := false
 	for _, match := range matches {
 		s, err := a.cache.get(match.other)
 		if err != nil {
-			log.Errorf("error getting scene with checksum %s: %s", match, err.Error())
+			a.addSceneError(match.other, err)
 			continue
 		}
 
-		newDetails += fmt.Sprintf("\nDuplicate ID: %s (score: %.f)", s.ID, -match.score)
+		notes := fmt.Sprintf("score: %.f", -match.score)
+		if match.phash {
+			notes = fmt.Sprintf("phash distance: %d", match.phashDistance)
+			if match.score != 0 {
+				notes += fmt.Sprintf(", score: %.f", -match.score)
+			}
+		}
+		if match.mirrored {
+			notes += ", mirrored"
+		}
+		if match.partial {
+			notes += ", partial"
+		} else {
+			whole = true
+		}
+		newDetails += fmt.Sprintf("\nDuplicate ID: %s (%s)", s.ID, notes)
 
 		if recurse {
 			a.handleDuplicate(m, match.other, false)
@@ -253,7 +911,14 @@ func (a *api) handleDuplicate(m matchInfoMap, checksum string, recurse bool) {
 	}
 	newDetails += "\n=== End Duplicate finder plugin ==="
 
-	if a.cfg.AddDetails || a.duplicateTagID != nil {
+	// scenes chosen to be kept during review, and scenes with only partial
+	// matches, are not tagged as duplicates
+	tagID := a.duplicateTagID
+	if a.decisions.isKeeper(checksum) || !whole {
+		tagID = nil
+	}
+
+	if a.cfg.AddDetails || tagID != nil {
 		details := ""
 		if subject.Details != nil {
 			details = string(*subject.Details)
@@ -265,9 +930,9 @@ func (a *api) handleDuplicate(m matchInfoMap, checksum string, recurse bool) {
 			newDetails = string(details)
 		}
 
-		err = updateScene(a.client, *subject, newDetails, a.duplicateTagID)
+		err = updateScene(a.client, *subject, newDetails, tagID)
 		if err != nil {
-			log.Errorf("Error updating scene: %s", err.Error())
+			a.addFailure("Error updating scene %s: %s", subject.ID, err.Error())
 		}
 	}
 }
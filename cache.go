@@ -2,45 +2,170 @@ package main
 
 import (
 	"fmt"
+	"sync"
+
+	"stash-plugin-duplicate-finder/internal/plugin/common/log"
 
 	"github.com/shurcooL/graphql"
 )
 
+// number of scenes fetched per query when warming the cache
+const prefetchPageSize = 1000
+
+// sceneNotFoundError is returned when no scene has the requested hash or id.
+type sceneNotFoundError string
+
+func (e sceneNotFoundError) Error() string {
+	return string(e)
+}
+
 type sceneCache struct {
+	// mutex guards the cache, which is used by the hashing goroutines
+	mutex sync.Mutex
+
+	// scenes indexed by checksum and oshash
 	scenes map[string]*Scene
-	client *graphql.Client
+	byID   map[string]*Scene
+	// hashes that do not match any scene
+	missing map[string]bool
+	client  *graphql.Client
+	warmed  bool
+
+	// algorithm is the video file naming algorithm used to name sprites
+	algorithm string
 }
 
-func newSceneCache(client *graphql.Client) *sceneCache {
+func newSceneCache(client *graphql.Client, algorithm string) *sceneCache {
 	return &sceneCache{
-		scenes: make(map[string]*Scene),
-		client: client,
+		scenes:    make(map[string]*Scene),
+		byID:      make(map[string]*Scene),
+		missing:   make(map[string]bool),
+		client:    client,
+		algorithm: algorithm,
+	}
+}
+
+func (c *sceneCache) add(s *Scene) {
+	if s.Checksum != nil && *s.Checksum != "" {
+		c.scenes[string(*s.Checksum)] = s
+	}
+	if s.Oshash != nil && *s.Oshash != "" {
+		c.scenes[string(*s.Oshash)] = s
+	}
+	c.byID[fmt.Sprint(s.ID)] = s
+}
+
+// warm populates the cache with all scenes using paginated queries.
+func (c *sceneCache) warm() error {
+	c.warmed = true
+
+	count := 0
+	for page := 1; ; page++ {
+		result, err := findScenes(c.client, page, prefetchPageSize)
+		if err != nil {
+			return err
+		}
+
+		for i := range result.Scenes {
+			c.add(&result.Scenes[i])
+		}
+
+		count += len(result.Scenes)
+		if len(result.Scenes) < prefetchPageSize || count >= int(result.Count) {
+			break
+		}
+	}
+
+	log.Debugf("Prefetched %d scenes", count)
+	return nil
+}
+
+// disablePrefetch makes the cache look up scenes individually rather than
+// prefetching all scenes, for runs that only need a few scenes.
+func (c *sceneCache) disablePrefetch() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.warmed = true
+}
+
+func (c *sceneCache) warmIfNeeded() {
+	if c.warmed {
+		return
+	}
+
+	if err := c.warm(); err != nil {
+		// fall back to single lookups
+		log.Warnf("error prefetching scenes: %s", err.Error())
 	}
 }
 
 func (c *sceneCache) get(hash string) (*Scene, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.warmIfNeeded()
+
 	if c.scenes[hash] != nil {
 		return c.scenes[hash], nil
 	}
 
+	if c.missing[hash] {
+		return nil, sceneNotFoundError(fmt.Sprintf("scene with hash %s is nil", hash))
+	}
+
+	// sprites are named using the current naming algorithm, but may have
+	// been generated using the other algorithm before migrating
+	lookups := []func(*graphql.Client, string) (*Scene, error){
+		findSceneFromChecksum,
+		findSceneFromOshash,
+	}
+	if c.algorithm == hashAlgorithmOshash {
+		lookups[0], lookups[1] = lookups[1], lookups[0]
+	}
+
 	var ret *Scene
-	var err error
-	if len(hash) == 32 {
-		ret, err = findSceneFromChecksum(c.client, hash)
+	for _, lookup := range lookups {
+		var err error
+		ret, err = lookup(c.client, hash)
 		if err != nil {
 			return nil, err
 		}
-	} else if len(hash) == 16 {
-		ret, err = findSceneFromOshash(c.client, hash)
-		if err != nil {
-			return nil, err
+
+		if ret != nil {
+			break
 		}
 	}
 
 	if ret == nil {
-		return nil, fmt.Errorf("scene with hash %s is nil", hash)
+		c.missing[hash] = true
+		return nil, sceneNotFoundError(fmt.Sprintf("scene with hash %s is nil", hash))
 	}
 
+	c.add(ret)
 	c.scenes[hash] = ret
 	return ret, nil
 }
+
+func (c *sceneCache) getByID(id string) (*Scene, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.warmIfNeeded()
+
+	if c.byID[id] != nil {
+		return c.byID[id], nil
+	}
+
+	ret, err := findSceneFromID(c.client, id)
+	if err != nil {
+		return nil, err
+	}
+
+	if ret == nil {
+		return nil, sceneNotFoundError(fmt.Sprintf("scene with id %s is nil", id))
+	}
+
+	c.add(ret)
+	return ret, nil
+}
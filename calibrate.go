@@ -0,0 +1,418 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/rivo/duplo"
+)
+
+// calibrationCandidates is the maximum number of values of each criterion
+// tried when searching for the best combination of criteria.
+const calibrationCandidates = 10
+
+// labelledPair is a pair of sprites that are known to be duplicates or
+// distinct.
+type labelledPair struct {
+	subject   string
+	other     string
+	duplicate bool
+
+	// match is nil if the sprites have no similarity
+	match *duplo.Match
+}
+
+// readLabelledPairs reads a CSV file of pairs, with the columns subject, other
+// and label. The label is either duplicate or not_duplicate. An optional
+// header row is ignored.
+func readLabelledPairs(fn string) ([]*labelledPair, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = 3
+	r.TrimLeadingSpace = true
+	r.Comment = '#'
+
+	var ret []*labelledPair
+	for line := 1; ; line++ {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if line == 1 && record[0] == "subject" {
+			continue
+		}
+
+		label := strings.ToLower(record[2])
+		if label != decisionDuplicate && label != decisionNotDuplicate {
+			return nil, fmt.Errorf("line %d: invalid label %s", line, record[2])
+		}
+
+		ret = append(ret, &labelledPair{
+			subject:   record[0],
+			other:     record[1],
+			duplicate: label == decisionDuplicate,
+		})
+	}
+
+	return ret, nil
+}
+
+// decisionPairs returns the reviewed pairs as labelled pairs, sorted by
+// subject and other.
+func decisionPairs(d decisions) []*labelledPair {
+	var ret []*labelledPair
+	for _, pd := range d {
+		ret = append(ret, &labelledPair{
+			subject:   pd.Subject,
+			other:     pd.Other,
+			duplicate: pd.Decision == decisionDuplicate,
+		})
+	}
+
+	sort.Slice(ret, func(i, j int) bool {
+		return pairKey(ret[i].subject, ret[i].other) < pairKey(ret[j].subject, ret[j].other)
+	})
+
+	return ret
+}
+
+// calibrationResult is the confusion matrix of a set of criteria applied to
+// the labelled pairs.
+type calibrationResult struct {
+	criteria matchCriteria
+	tp       int
+	fp       int
+	fn       int
+	tn       int
+}
+
+func evaluateCriteria(c matchCriteria, pairs []*labelledPair) calibrationResult {
+	ret := calibrationResult{criteria: c}
+	for _, p := range pairs {
+		matched := c.isMatch(p.match)
+		switch {
+		case matched && p.duplicate:
+			ret.tp++
+		case matched:
+			ret.fp++
+		case p.duplicate:
+			ret.fn++
+		default:
+			ret.tn++
+		}
+	}
+
+	return ret
+}
+
+func ratio(a, b int) float64 {
+	if b == 0 {
+		return 0
+	}
+
+	return float64(a) / float64(b)
+}
+
+func (r calibrationResult) precision() float64 {
+	return ratio(r.tp, r.tp+r.fp)
+}
+
+func (r calibrationResult) recall() float64 {
+	return ratio(r.tp, r.tp+r.fn)
+}
+
+// falsePositiveRate returns the proportion of distinct pairs that are
+// matched.
+func (r calibrationResult) falsePositiveRate() float64 {
+	return ratio(r.fp, r.fp+r.tn)
+}
+
+func (r calibrationResult) f1() float64 {
+	p := r.precision()
+	rc := r.recall()
+	if p+rc == 0 {
+		return 0
+	}
+
+	return 2 * p * rc / (p + rc)
+}
+
+// limits returns the number of metric limits enabled in the criteria.
+func (c matchCriteria) limits() int {
+	ret := 0
+	if c.MaxRatioDiff > 0 {
+		ret++
+	}
+	if c.MaxDHashDistance > 0 {
+		ret++
+	}
+	if c.MaxHistogramDistance > 0 {
+		ret++
+	}
+
+	return ret
+}
+
+// candidateValues returns up to n evenly spaced values of the sorted distinct
+// values, always including the smallest and largest.
+func candidateValues(values []float64, n int) []float64 {
+	sort.Float64s(values)
+
+	var distinct []float64
+	for i, v := range values {
+		if i == 0 || v != values[i-1] {
+			distinct = append(distinct, v)
+		}
+	}
+
+	if len(distinct) <= n {
+		return distinct
+	}
+
+	var ret []float64
+	for i := 0; i < n; i++ {
+		ret = append(ret, distinct[i*(len(distinct)-1)/(n-1)])
+	}
+
+	return ret
+}
+
+// calibration contains the labelled pairs and their match metrics.
+type calibration struct {
+	pairs []*labelledPair
+
+	// skipped are the pairs that could not be compared
+	skipped int
+}
+
+// duplicates returns the number of pairs labelled as duplicates.
+func (c *calibration) duplicates() int {
+	ret := 0
+	for _, p := range c.pairs {
+		if p.duplicate {
+			ret++
+		}
+	}
+
+	return ret
+}
+
+// thresholdResults returns the results of the score threshold alone. The
+// thresholds are up to n of the scores of the pairs, so that each result is
+// a distinct trade-off between precision and recall.
+func (c *calibration) thresholdResults(n int) []calibrationResult {
+	var scores []float64
+	for _, p := range c.pairs {
+		if p.match != nil {
+			scores = append(scores, math.Floor(-p.match.Score))
+		}
+	}
+
+	var ret []calibrationResult
+	for _, t := range candidateValues(scores, n) {
+		ret = append(ret, evaluateCriteria(matchCriteria{Threshold: int(t)}, c.pairs))
+	}
+
+	return ret
+}
+
+// recommend returns the criteria of the result with the threshold moved
+// halfway towards the highest score of a distinct pair below it, if this does
+// not change the result. This leaves a margin for duplicates with lower
+// scores than the labelled pairs.
+func (c *calibration) recommend(r calibrationResult) matchCriteria {
+	ret := r.criteria
+
+	lower := math.Inf(-1)
+	for _, p := range c.pairs {
+		if p.match != nil && !p.duplicate && -p.match.Score < float64(ret.Threshold) {
+			lower = math.Max(lower, math.Ceil(-p.match.Score))
+		}
+	}
+
+	if math.IsInf(lower, -1) {
+		return ret
+	}
+
+	mid := ret
+	mid.Threshold = int(math.Ceil((lower + float64(ret.Threshold)) / 2))
+	if m := evaluateCriteria(mid, c.pairs); m.tp == r.tp && m.fp == r.fp {
+		return mid
+	}
+
+	return ret
+}
+
+// bestResults returns the n best combinations of criteria, ordered by F1
+// score. Combinations with fewer metric limits and higher recall are
+// preferred when the F1 scores are equal. The candidate values of each
+// criterion are taken from the pairs labelled as duplicates.
+func (c *calibration) bestResults(n int) []calibrationResult {
+	var scores, ratioDiffs, dhashes, histograms []float64
+	for _, p := range c.pairs {
+		if !p.duplicate || p.match == nil {
+			continue
+		}
+
+		scores = append(scores, math.Floor(-p.match.Score))
+		if p.match.RatioDiff > 0 {
+			ratioDiffs = append(ratioDiffs, p.match.RatioDiff)
+		}
+		if p.match.DHashDistance > 0 {
+			dhashes = append(dhashes, float64(p.match.DHashDistance))
+		}
+		if p.match.HistogramDistance > 0 {
+			histograms = append(histograms, float64(p.match.HistogramDistance))
+		}
+	}
+
+	// 0 disables the limit
+	thresholds := candidateValues(scores, calibrationCandidates*2)
+	ratioDiffs = append([]float64{0}, candidateValues(ratioDiffs, calibrationCandidates)...)
+	dhashes = append([]float64{0}, candidateValues(dhashes, calibrationCandidates)...)
+	histograms = append([]float64{0}, candidateValues(histograms, calibrationCandidates)...)
+
+	var ret []calibrationResult
+	for _, t := range thresholds {
+		for _, rd := range ratioDiffs {
+			for _, dh := range dhashes {
+				for _, h := range histograms {
+					ret = append(ret, evaluateCriteria(matchCriteria{
+						Threshold:            int(t),
+						MaxRatioDiff:         rd,
+						MaxDHashDistance:     int(dh),
+						MaxHistogramDistance: int(h),
+					}, c.pairs))
+				}
+			}
+		}
+	}
+
+	sort.SliceStable(ret, func(i, j int) bool {
+		if ret[i].f1() != ret[j].f1() {
+			return ret[i].f1() > ret[j].f1()
+		}
+		if ret[i].criteria.limits() != ret[j].criteria.limits() {
+			return ret[i].criteria.limits() < ret[j].criteria.limits()
+		}
+		return ret[i].recall() > ret[j].recall()
+	})
+
+	if len(ret) > n {
+		ret = ret[:n]
+	}
+
+	return ret
+}
+
+func formatLimit(v float64, format string) string {
+	if v <= 0 {
+		return "-"
+	}
+
+	return fmt.Sprintf(format, v)
+}
+
+func (c *calibration) print(w io.Writer, rows int) {
+	dupes := c.duplicates()
+	fmt.Fprintf(w, "Labelled pairs: %d (%d duplicate, %d distinct)\n", len(c.pairs), dupes, len(c.pairs)-dupes)
+	if c.skipped > 0 {
+		fmt.Fprintf(w, "Skipped pairs: %d\n", c.skipped)
+	}
+
+	thresholdResults := c.thresholdResults(rows)
+	if len(thresholdResults) == 0 || dupes == 0 || dupes == len(c.pairs) {
+		fmt.Fprintln(w, "\nBoth duplicate and distinct pairs with similarity are required to calibrate")
+		return
+	}
+
+	fmt.Fprintln(w, "\nThreshold only:")
+	fmt.Fprintf(w, "%9s %5s %5s %5s %5s %9s %6s %6s\n", "threshold", "tp", "fp", "fn", "tn", "precision", "recall", "fpr")
+	for _, r := range thresholdResults {
+		fmt.Fprintf(w, "%9d %5d %5d %5d %5d %9.3f %6.3f %6.3f\n", r.criteria.Threshold, r.tp, r.fp, r.fn, r.tn, r.precision(), r.recall(), r.falsePositiveRate())
+	}
+
+	best := c.bestResults(5)
+	fmt.Fprintln(w, "\nBest combinations:")
+	fmt.Fprintf(w, "%9s %10s %5s %9s %9s %6s %6s\n", "threshold", "ratio_diff", "dhash", "histogram", "precision", "recall", "f1")
+	for _, r := range best {
+		cr := r.criteria
+		fmt.Fprintf(w, "%9d %10s %5s %9s %9.3f %6.3f %6.3f\n", cr.Threshold,
+			formatLimit(cr.MaxRatioDiff, "%.4f"), formatLimit(float64(cr.MaxDHashDistance), "%.f"), formatLimit(float64(cr.MaxHistogramDistance), "%.f"),
+			r.precision(), r.recall(), r.f1())
+	}
+
+	cr := c.recommend(best[0])
+	fmt.Fprintln(w, "\nRecommended configuration:")
+	fmt.Fprintf(w, "threshold: %d\n", cr.Threshold)
+	fmt.Fprintf(w, "max_ratio_diff: %g\n", cr.MaxRatioDiff)
+	fmt.Fprintf(w, "max_dhash_distance: %d\n", cr.MaxDHashDistance)
+	fmt.Fprintf(w, "max_histogram_distance: %d\n", cr.MaxHistogramDistance)
+}
+
+// calibrate compares the sprites of each pair, prepared using the options
+// returned by hashOptions. The sprite filename of each pair member is resolved
+// using resolve. Pairs that cannot be compared are logged and skipped.
+func calibrate(pairs []*labelledPair, resolve func(string) (string, error), hashOptions func(string) spriteHashOptions) *calibration {
+	ret := &calibration{}
+	hashes := make(map[string]*duplo.Hash)
+
+	getHash := func(name string) (string, *duplo.Hash, error) {
+		fn, err := resolve(name)
+		if err != nil {
+			return "", nil, err
+		}
+
+		if h, found := hashes[fn]; found {
+			return fn, h, nil
+		}
+
+		h, err := getImageHashes(fn, hashOptions(getChecksum(fn)))
+		if err != nil {
+			return "", nil, err
+		}
+
+		hashes[fn] = &h.hash
+		return fn, &h.hash, nil
+	}
+
+	for _, p := range pairs {
+		_, hash, err := getHash(p.subject)
+		if err == nil {
+			var otherFn string
+			var otherHash *duplo.Hash
+			otherFn, otherHash, err = getHash(p.other)
+			if err == nil {
+				store := duplo.New()
+				store.Add(otherFn, *otherHash)
+				if matches := store.Query(*hash); len(matches) > 0 {
+					p.match = matches[0]
+				}
+			}
+		}
+
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Skipping %s - %s: %s\n", p.subject, p.other, err.Error())
+			ret.skipped++
+			continue
+		}
+
+		ret.pairs = append(ret.pairs, p)
+	}
+
+	return ret
+}
@@ -1,56 +1,997 @@
 package main
 
 import (
+	"errors"
+	"flag"
 	"fmt"
 	"os"
-	"time"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+
+	"stash-plugin-duplicate-finder/internal/plugin/common/log"
+	"stash-plugin-duplicate-finder/internal/plugin/util"
 
 	"github.com/rivo/duplo"
 )
 
+// errUsage is returned by commands when the arguments are invalid.
+var errUsage = errors.New("invalid arguments")
+
+// command is a command-line subcommand.
+type command struct {
+	name        string
+	args        string
+	description string
+
+	// flags registers the flags of the command into o
+	flags func(fs *flag.FlagSet, o *cmdOptions)
+
+	minArgs int
+	maxArgs int
+
+	run func(o *cmdOptions, args []string) error
+}
+
+func getCommands() []command {
+	return []command{
+		{
+			name:        "scan",
+			args:        "[sprite directory]",
+			description: "hashes the sprite files in the directory and reports any duplicates",
+			flags: func(fs *flag.FlagSet, o *cmdOptions) {
+				o.addConfigFlags(fs)
+				o.addConnectionFlags(fs)
+				o.addOutputFlags(fs, "duplicates")
+				fs.IntVar(&o.workers, "workers", 0, "number of files to hash concurrently (overrides workers)")
+			},
+			maxArgs: 1,
+			run:     cmdScan,
+		},
+		{
+			name:        "query",
+			args:        "<sprite file, checksum or scene id>",
+			description: "reports the matches of a single scene in the database. The scene is only added and tagged if a server URL is set",
+			flags: func(fs *flag.FlagSet, o *cmdOptions) {
+				o.addConfigFlags(fs)
+				o.addConnectionFlags(fs)
+			},
+			minArgs: 1,
+			maxArgs: 1,
+			run:     cmdQuery,
+		},
+		{
+			name:        "compare",
+			args:        "<sprite file, checksum or scene id> <sprite file, checksum or scene id>",
+			description: "compares two sprite files and explains the match score. Scene ids require a server URL",
+			flags: func(fs *flag.FlagSet, o *cmdOptions) {
+				o.addConfigFlags(fs)
+				o.addConnectionFlags(fs)
+			},
+			minArgs: 2,
+			maxArgs: 2,
+			run:     cmdCompare,
+		},
+		{
+			name:        "calibrate",
+			args:        "[sprite directory]",
+			description: "recommends matching criteria using labelled pairs of duplicate and distinct scenes",
+			flags: func(fs *flag.FlagSet, o *cmdOptions) {
+				o.addConfigFlags(fs)
+				o.addConnectionFlags(fs)
+				fs.StringVar(&o.pairs, "pairs", "", "CSV file of labelled pairs. Defaults to the pairs in the decisions file")
+				fs.IntVar(&o.rows, "rows", 20, "maximum number of rows of the threshold table")
+			},
+			maxArgs: 1,
+			run:     cmdCalibrate,
+		},
+		{
+			name:        "export",
+			args:        "[sprite directory]",
+			description: "writes the matches found by previous scans",
+			flags: func(fs *flag.FlagSet, o *cmdOptions) {
+				o.addConfigFlags(fs)
+				o.addConnectionFlags(fs)
+				o.addOutputFlags(fs, "duplicates")
+			},
+			maxArgs: 1,
+			run:     cmdExport,
+		},
+		{
+			name:        "serve",
+			args:        "[sprite directory]",
+			description: "serves a web page to review the matches found by previous scans",
+			flags: func(fs *flag.FlagSet, o *cmdOptions) {
+				o.addConfigFlags(fs)
+				o.addConnectionFlags(fs)
+				fs.StringVar(&o.listen, "listen", "127.0.0.1:8080", "address to listen on")
+			},
+			maxArgs: 1,
+			run:     cmdServe,
+		},
+		{
+			name:        "prune",
+			args:        "[sprite directory]",
+			description: "removes hashes of sprite files that no longer exist from the database",
+			flags: func(fs *flag.FlagSet, o *cmdOptions) {
+				o.addConfigFlags(fs)
+				o.addConnectionFlags(fs)
+			},
+			maxArgs: 1,
+			run:     cmdPrune,
+		},
+		{
+			name:        "intros",
+			args:        "[sprite directory]",
+			description: "finds the intros and outros shared by many sprites and writes them to the intros file",
+			flags: func(fs *flag.FlagSet, o *cmdOptions) {
+				o.addConfigFlags(fs)
+				o.addConnectionFlags(fs)
+			},
+			maxArgs: 1,
+			run:     cmdIntros,
+		},
+		{
+			name:        "images",
+			args:        "",
+			description: "hashes the images of the stash server and reports any duplicate images and overlapping galleries. Requires a server URL",
+			flags: func(fs *flag.FlagSet, o *cmdOptions) {
+				o.addConfigFlags(fs)
+				o.addConnectionFlags(fs)
+				o.addOutputFlags(fs, "image-duplicates")
+			},
+			run: cmdImages,
+		},
+		{
+			name:        "phash",
+			args:        "",
+			description: "matches the scenes of the stash server by the phashes generated by stash, and reports and handles any duplicates. Requires a server URL",
+			flags: func(fs *flag.FlagSet, o *cmdOptions) {
+				o.addConfigFlags(fs)
+				o.addConnectionFlags(fs)
+				fs.StringVar(&o.output, "output", "phash-duplicates.csv", "output file. - writes to stdout")
+			},
+			run: cmdPhash,
+		},
+		{
+			name:        "markers",
+			args:        "",
+			description: "creates, updates and removes the duplicate markers of the stash server to match the segments of previous scans. Requires a server URL and marker_tag_name",
+			flags: func(fs *flag.FlagSet, o *cmdOptions) {
+				o.addConfigFlags(fs)
+				o.addConnectionFlags(fs)
+			},
+			run: cmdMarkers,
+		},
+		{
+			name:        "verify-db",
+			args:        "",
+			description: "checks that the database and matches file can be read and are consistent",
+			flags: func(fs *flag.FlagSet, o *cmdOptions) {
+				o.addConfigFlags(fs)
+			},
+			run: cmdVerifyDB,
+		},
+		{
+			name:        "stats",
+			args:        "",
+			description: "outputs statistics about the database and matches",
+			flags: func(fs *flag.FlagSet, o *cmdOptions) {
+				o.addConfigFlags(fs)
+			},
+			run: cmdStats,
+		},
+	}
+}
+
+func cmdUsage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage: %s <command> [flags] [arguments]\n\n", os.Args[0])
+	fmt.Fprintln(out, "Commands:")
+	for _, c := range getCommands() {
+		fmt.Fprintf(out, "  %-10s %s\n", c.name, c.description)
+	}
+	fmt.Fprintf(out, "\nRun '%s <command> -h' for the flags of a command.\n", os.Args[0])
+}
+
 func cmdMain() {
-	// default is to accept sprite directory and output csv of all matches
-	path := os.Args[1]
+	name := os.Args[1]
+	switch name {
+	case "-h", "-help", "--help", "help":
+		cmdUsage()
+		return
+	}
 
-	fmt.Fprintln(os.Stderr, "Outputting duplicates to csv")
+	var cmd *command
+	commands := getCommands()
+	for i := range commands {
+		if commands[i].name == name {
+			cmd = &commands[i]
+		}
+	}
 
-	f, err := os.Create("duplicates.csv")
+	if cmd == nil {
+		fmt.Fprintf(os.Stderr, "Unknown command: %s\n\n", name)
+		cmdUsage()
+		os.Exit(2)
+	}
+
+	o := &cmdOptions{}
+	fs := flag.NewFlagSet(cmd.name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s %s [flags] %s\n\n", os.Args[0], cmd.name, cmd.args)
+		fmt.Fprintf(fs.Output(), "%s %s.\n\nFlags:\n", cmd.name, cmd.description)
+		fs.PrintDefaults()
+	}
+	cmd.flags(fs, o)
+
+	if err := fs.Parse(os.Args[2:]); err != nil {
+		if err == flag.ErrHelp {
+			return
+		}
+		os.Exit(2)
+	}
+
+	if fs.NArg() < cmd.minArgs || fs.NArg() > cmd.maxArgs {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	log.SetPlain(true)
+
+	if err := cmd.run(o, fs.Args()); err != nil {
+		if err == errUsage {
+			fs.Usage()
+			os.Exit(2)
+		}
+
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err.Error())
+		os.Exit(1)
+	}
+}
+
+// printMatch outputs the match of the subject sprite and returns its result.
+// If otherOnly is true, then the subject is not output.
+func (a *api) printMatch(subject string, m *duplo.Match, otherOnly bool) *matchResult {
+	r := newMatchResult(subject, m, a.mirrored[pairKey(subject, m.ID.(string))])
+	matchResults{r}.setAspectRatios(a.meta)
+	matchResults{r}.setSegments(a.segments)
+	matchResults{r}.setPartial(a.partial)
+	matchResults{r}.setDurationScores(a.durationScores)
+
+	if otherOnly {
+		fmt.Printf("%s [%.f%s]\n", r.Other, -r.Score, r.notes())
+	} else {
+		fmt.Printf("%s - %s [%.f%s]\n", r.Subject, r.Other, -r.Score, r.notes())
+	}
+
+	return r
+}
+
+// cmdOptions contains the flag values of all commands.
+type cmdOptions struct {
+	configFile  string
+	dbFile      string
+	threshold   int
+	mirrored    bool
+	cropBorders bool
+	skipTiles   bool
+	durDiff     float64
+	workers     int
+
+	serverURL     string
+	generatedPath string
+	apiKey        string
+	caCert        string
+	insecure      bool
+	timeout       int
+
+	output string
+	format string
+
+	// outputName is the name of the output file without the extension,
+	// used if output is not set
+	outputName string
+
+	listen string
+
+	pairs string
+	rows  int
+}
+
+func (o *cmdOptions) addConfigFlags(fs *flag.FlagSet) {
+	fs.StringVar(&o.configFile, "config", "duplicate-finder.cfg", "configuration file")
+	fs.StringVar(&o.dbFile, "db", "", "image hash database file (overrides db_filename)")
+	fs.IntVar(&o.threshold, "threshold", -1, "threshold for image matches (overrides threshold)")
+	fs.BoolVar(&o.mirrored, "mirrored", false, "also match mirrored copies of sprites (overrides match_mirrored)")
+	fs.BoolVar(&o.cropBorders, "crop-borders", false, "remove uniform borders from tiles before hashing (overrides crop_borders)")
+	fs.BoolVar(&o.skipTiles, "skip-uninformative", false, "exclude tiles without enough detail from hashing (overrides skip_uninformative_tiles)")
+	fs.Float64Var(&o.durDiff, "max-duration-diff", -1, "maximum difference between the durations of whole scene duplicates, as a percentage (overrides max_duration_diff)")
+}
+
+func (o *cmdOptions) addConnectionFlags(fs *flag.FlagSet) {
+	fs.StringVar(&o.serverURL, "url", "", "URL of the stash server, such as http://localhost:9999. If set, duplicates are handled as in plugin mode")
+	fs.StringVar(&o.generatedPath, "generated", "", "generated files directory of the stash server. Used instead of the sprite directory, which defaults to the server setting")
+	fs.StringVar(&o.apiKey, "api-key", "", "API key for stash authentication (overrides api_key)")
+	fs.StringVar(&o.caCert, "ca-cert", "", "PEM encoded CA certificate bundle (overrides ca_cert)")
+	fs.BoolVar(&o.insecure, "insecure", false, "do not verify the server certificate (overrides insecure_skip_verify)")
+	fs.IntVar(&o.timeout, "timeout", -1, "request timeout in seconds (overrides timeout)")
+}
+
+// addOutputFlags registers the output flags. The output file defaults to name
+// with the extension of the format.
+func (o *cmdOptions) addOutputFlags(fs *flag.FlagSet, name string) {
+	o.outputName = name
+	fs.StringVar(&o.output, "output", "", "output file. Defaults to "+name+" with the extension of the format. - writes to stdout")
+	fs.StringVar(&o.format, "format", reportFormatCSV, "output format. Valid values: "+strings.Join(reportFormats, ", "))
+}
+
+// checkOutput validates the output format and sets the default output file.
+func (o *cmdOptions) checkOutput() error {
+	if !isValidReportFormat(o.format) {
+		return fmt.Errorf("invalid format: %s", o.format)
+	}
+
+	if o.output == "" {
+		o.output = o.outputName + "." + o.format
+	}
+
+	return nil
+}
+
+// loadConfig reads the configuration file and applies the flag overrides.
+func (o *cmdOptions) loadConfig() (*config, error) {
+	cfg, err := readConfig(o.configFile)
 	if err != nil {
-		panic(err)
+		return nil, fmt.Errorf("error reading configuration file: %s", err.Error())
+	}
+
+	if o.dbFile != "" {
+		cfg.DBFilename = o.dbFile
+	}
+	if o.threshold >= 0 {
+		cfg.Threshold = o.threshold
+	}
+	if o.mirrored {
+		cfg.MatchMirrored = true
+	}
+	if o.cropBorders {
+		cfg.CropBorders = true
+	}
+	if o.skipTiles {
+		cfg.SkipUninformativeTiles = true
+	}
+	if o.durDiff >= 0 {
+		cfg.MaxDurationDiff = o.durDiff
+	}
+	if o.workers > 0 {
+		cfg.Workers = o.workers
+	}
+	if o.apiKey != "" {
+		cfg.APIKey = o.apiKey
+	}
+	if o.caCert != "" {
+		cfg.CACert = o.caCert
+	}
+	if o.insecure {
+		cfg.InsecureSkipVerify = true
+	}
+	if o.timeout >= 0 {
+		cfg.Timeout = o.timeout
+	}
+
+	return cfg, nil
+}
+
+// newAPI returns an api using the configuration, connected to the stash
+// server if a server URL was provided.
+func (o *cmdOptions) newAPI() (*api, error) {
+	cfg, err := o.loadConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	a := &api{
+		cfg:       *cfg,
+		serverURL: o.serverURL,
+	}
+
+	if o.serverURL != "" {
+		a.client, err = util.NewClientFromURL(o.serverURL, a.cfg.clientOptions())
+		if err != nil {
+			return nil, err
+		}
+
+		if err := a.connect(); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := a.loadIntros(); err != nil {
+		return nil, err
+	}
+
+	return a, nil
+}
+
+// spriteDir returns the sprite directory from the arguments, the generated
+// path flag or the server configuration, in that order.
+func (o *cmdOptions) spriteDir(a *api, args []string) (string, error) {
+	if len(args) > 0 {
+		return args[0], nil
+	}
+
+	if o.generatedPath != "" {
+		return filepath.Join(o.generatedPath, "vtt"), nil
+	}
+
+	if a.client != nil {
+		return getSpriteDir(a.client)
+	}
+
+	return "", errUsage
+}
+
+// writeReport writes the results to the output file. Scene metadata is
+// included if a is connected to a server.
+func (o *cmdOptions) writeReport(a *api, results matchResults, spriteDir string) error {
+	r := report{
+		results:   results,
+		cache:     a.cache,
+		spriteDir: spriteDir,
+		serverURL: a.serverURL,
+		decisions: a.decisions,
 	}
-	defer f.Close()
 
-	// output to stdout
-	a := api{}
-	a.cfg.DBFilename = "df-hashstore.db"
+	if o.output == "-" {
+		return r.write(os.Stdout, o.format)
+	}
+
+	return r.writeFile(o.output, o.format)
+}
+
+func cmdScan(o *cmdOptions, args []string) error {
+	if err := o.checkOutput(); err != nil {
+		return err
+	}
+
+	a, err := o.newAPI()
+	if err != nil {
+		return err
+	}
+
+	path, err := o.spriteDir(a, args)
+	if err != nil {
+		return err
+	}
+
+	var results matchResults
 	hdFunc := func(checksum string, matches duplo.Matches) {
-		if len(matches) > 0 {
-			match := matches[0]
-			fmt.Fprintf(f, "%s,%s,%.f\n", checksum, match.ID.(string), -match.Score)
-			fmt.Printf("%s - %s [%.f]\n", checksum, match.ID.(string), -match.Score)
+		for _, match := range matches {
+			results = append(results, a.printMatch(checksum, match, false))
 		}
 	}
 
-	c := make(chan bool, 1)
+	c := make(chan error, 1)
 
 	go func() {
-		err = a.processFiles(path, hdFunc)
-		if err != nil {
-			panic(err)
+		if a.client != nil {
+			c <- a.findDuplicates(path, nil, hdFunc)
+		} else {
+			c <- a.processFiles(path, nil, hdFunc)
 		}
-		c <- true
 	}()
 
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+
 	for {
 		select {
-		case <-c:
-			return
-		default:
-			_, err := os.Stat(".stop")
-			if err == nil {
-				a.stopping = true
+		case err := <-c:
+			if err != nil {
+				return err
+			}
+
+			if a.isStopping() {
+				fmt.Fprintln(os.Stderr, "Stopped before all files were processed")
+			}
+
+			fmt.Fprintf(os.Stderr, "Writing duplicates to %s\n", o.output)
+			return o.writeReport(a, results, path)
+		case <-sigs:
+			if a.isStopping() {
+				fmt.Fprintln(os.Stderr, "Forcing exit without saving")
+				os.Exit(1)
+			}
+
+			fmt.Fprintln(os.Stderr, "Stopping after the current file. Interrupt again to force exit.")
+			a.stop()
+		}
+	}
+}
+
+func cmdQuery(o *cmdOptions, args []string) error {
+	a, err := o.newAPI()
+	if err != nil {
+		return err
+	}
+
+	// the sprite directory is only required for checksums and scene ids
+	path, err := o.spriteDir(a, nil)
+	if err != nil && err != errUsage {
+		return err
+	}
+
+	if a.client != nil {
+		found := 0
+		hdFunc := func(checksum string, matches duplo.Matches) {
+			for _, m := range matches {
+				a.printMatch(checksum, m, true)
+			}
+			found += len(matches)
+		}
+
+		if err := a.findSceneDuplicates(path, args[0], hdFunc); err != nil {
+			return err
+		}
+
+		fmt.Fprintf(os.Stderr, "%d matches found\n", found)
+		return nil
+	}
+
+	fn, err := a.resolveSprite(path, args[0])
+	if err != nil {
+		return err
+	}
+
+	checksum := getChecksum(fn)
+	hashOptions := a.hashOptions(checksum)
+	hashOptions.tileHashes = a.needsTileHashes(filepath.Dir(fn), checksum)
+	hashes, err := getImageHashes(fn, hashOptions)
+	if err != nil {
+		return err
+	}
+
+	store := duplo.New()
+	if err := readDB(store, a.cfg.DBFilename); err != nil {
+		return fmt.Errorf("error reading database: %s", err.Error())
+	}
+
+	a.meta, err = readMeta(a.cfg.MetaFilename)
+	if err != nil {
+		return fmt.Errorf("error reading meta file: %s", err.Error())
+	}
+
+	if meta := a.setMeta(checksum, hashes); meta.LowInformation {
+		fmt.Fprintf(os.Stderr, "%s has too few informative tiles to be matched (%d)\n", filepath.Base(fn), meta.informativeTiles())
+		return nil
+	}
+
+	matches := a.queryHash(store, checksum, hashes.hash, hashes.mirroredHash)
+	a.alignMatches(filepath.Dir(fn), checksum, hashes, matches)
+	matches = a.filterDurations(filepath.Dir(fn), checksum, matches)
+	for _, m := range matches {
+		a.printMatch(checksum, m, true)
+	}
+
+	fmt.Fprintf(os.Stderr, "%d matches found\n", len(matches))
+	return nil
+}
+
+func cmdCompare(o *cmdOptions, args []string) error {
+	a, err := o.newAPI()
+	if err != nil {
+		return err
+	}
+
+	// the sprite directory is only required for scene ids
+	path, err := o.spriteDir(a, nil)
+	if err != nil && err != errUsage {
+		return err
+	}
+
+	fn, err := a.resolveSprite(path, args[0])
+	if err != nil {
+		return err
+	}
+
+	otherFn, err := a.resolveSprite(path, args[1])
+	if err != nil {
+		return err
+	}
+
+	c, err := a.compareSprites(fn, otherFn)
+	if err != nil {
+		return err
+	}
+
+	c.print(os.Stdout)
+	return nil
+}
+
+func cmdCalibrate(o *cmdOptions, args []string) error {
+	if o.rows < 2 {
+		return errUsage
+	}
+
+	a, err := o.newAPI()
+	if err != nil {
+		return err
+	}
+
+	var pairs []*labelledPair
+	if o.pairs != "" {
+		pairs, err = readLabelledPairs(o.pairs)
+		if err != nil {
+			return fmt.Errorf("error reading pairs file: %s", err.Error())
+		}
+	} else {
+		d, err := readDecisions(a.cfg.DecisionsFilename)
+		if err != nil {
+			return fmt.Errorf("error reading decisions file: %s", err.Error())
+		}
+		pairs = decisionPairs(d)
+	}
+
+	// the sprite directory is only required for sprite names and scene ids
+	path, err := o.spriteDir(a, args)
+	if err != nil && err != errUsage {
+		return err
+	}
+
+	c := calibrate(pairs, func(name string) (string, error) {
+		return a.resolveSprite(path, name)
+	}, a.hashOptions)
+
+	c.print(os.Stdout, o.rows)
+	return nil
+}
+
+func cmdExport(o *cmdOptions, args []string) error {
+	if err := o.checkOutput(); err != nil {
+		return err
+	}
+
+	a, err := o.newAPI()
+	if err != nil {
+		return err
+	}
+
+	results, err := readMatches(a.cfg.MatchesFilename)
+	if err != nil {
+		return fmt.Errorf("error reading matches file: %s", err.Error())
+	}
+
+	a.decisions, err = readDecisions(a.cfg.DecisionsFilename)
+	if err != nil {
+		return fmt.Errorf("error reading decisions file: %s", err.Error())
+	}
+
+	// the sprite directory is only required for sprite images
+	path, err := o.spriteDir(a, args)
+	if err != nil && err != errUsage {
+		return err
+	}
+
+	return o.writeReport(a, results, path)
+}
+
+func cmdServe(o *cmdOptions, args []string) error {
+	a, err := o.newAPI()
+	if err != nil {
+		return err
+	}
+
+	results, err := readMatches(a.cfg.MatchesFilename)
+	if err != nil {
+		return fmt.Errorf("error reading matches file: %s", err.Error())
+	}
+
+	d, err := readDecisions(a.cfg.DecisionsFilename)
+	if err != nil {
+		return fmt.Errorf("error reading decisions file: %s", err.Error())
+	}
+
+	// the sprite directory is only required for sprite images
+	path, err := o.spriteDir(a, args)
+	if err != nil && err != errUsage {
+		return err
+	}
+
+	s := &reviewServer{
+		report: report{
+			results:   results,
+			cache:     a.cache,
+			serverURL: a.serverURL,
+		},
+		spriteDir:     path,
+		decisionsFile: a.cfg.DecisionsFilename,
+		decisions:     d,
+	}
+
+	return s.serve(o.listen)
+}
+
+func cmdPrune(o *cmdOptions, args []string) error {
+	a, err := o.newAPI()
+	if err != nil {
+		return err
+	}
+
+	path, err := o.spriteDir(a, args)
+	if err != nil {
+		return err
+	}
+
+	lock, err := a.lockDB()
+	if err != nil {
+		return err
+	}
+	defer lock.release()
+
+	store := duplo.New()
+	if err := readDB(store, a.cfg.DBFilename); err != nil {
+		return fmt.Errorf("error reading database: %s", err.Error())
+	}
+
+	removed := 0
+	for _, id := range store.IDs() {
+		if _, err := os.Stat(getSpriteFilename(path, id.(string))); os.IsNotExist(err) {
+			store.Delete(id)
+			removed++
+		}
+	}
+
+	matches, err := readMatches(a.cfg.MatchesFilename)
+	if err != nil {
+		return fmt.Errorf("error reading matches file: %s", err.Error())
+	}
+
+	matches = matches.filter(func(r *matchResult) bool {
+		return store.Has(r.Subject) && store.Has(r.Other)
+	})
+
+	meta, err := readMeta(a.cfg.MetaFilename)
+	if err != nil {
+		return fmt.Errorf("error reading meta file: %s", err.Error())
+	}
+
+	meta.prune(path, store)
+
+	if err := storeDB(store, a.cfg.DBFilename); err != nil {
+		return fmt.Errorf("error writing database: %s", err.Error())
+	}
+	if err := storeMatches(matches, a.cfg.MatchesFilename); err != nil {
+		return fmt.Errorf("error writing matches file: %s", err.Error())
+	}
+	if err := storeMeta(meta, a.cfg.MetaFilename); err != nil {
+		return fmt.Errorf("error writing meta file: %s", err.Error())
+	}
+
+	fmt.Printf("Removed %d hashes. %d hashes remaining.\n", removed, store.Size())
+	return nil
+}
+
+func cmdIntros(o *cmdOptions, args []string) error {
+	a, err := o.newAPI()
+	if err != nil {
+		return err
+	}
+
+	path, err := o.spriteDir(a, args)
+	if err != nil {
+		return err
+	}
+
+	intros, err := a.detectIntros(path)
+	if err != nil {
+		return err
+	}
+
+	for _, i := range intros {
+		fmt.Printf("%-5s %d tiles, found in %d scenes\n", i.Position, len(i.Hashes), i.Scenes)
+	}
+
+	fmt.Printf("Found %d intros and outros. Written to %s\n", len(intros), a.cfg.IntrosFilename)
+	return nil
+}
+
+func cmdImages(o *cmdOptions, args []string) error {
+	if err := o.checkOutput(); err != nil {
+		return err
+	}
+
+	a, err := o.newAPI()
+	if err != nil {
+		return err
+	}
+
+	if a.client == nil {
+		return errors.New("a server URL is required to find duplicate images")
+	}
+
+	generatedPath := o.generatedPath
+	if generatedPath == "" {
+		spriteDir, err := getSpriteDir(a.client)
+		if err != nil {
+			return err
+		}
+		generatedPath = filepath.Dir(spriteDir)
+	}
+
+	results, overlaps, err := a.findImageDuplicates(generatedPath)
+	if err != nil {
+		return err
+	}
+
+	for _, r := range results {
+		fmt.Printf("%s - %s [%.f]\n", r.Subject, r.Other, -r.Score)
+	}
+	for _, g := range overlaps {
+		fmt.Printf("Galleries %s\n", g)
+	}
+
+	// images are not scenes, so scene metadata is not included
+	fmt.Fprintf(os.Stderr, "Writing duplicate images to %s\n", o.output)
+	r := report{results: results}
+	if o.output == "-" {
+		return r.write(os.Stdout, o.format)
+	}
+
+	return r.writeFile(o.output, o.format)
+}
+
+func cmdPhash(o *cmdOptions, args []string) error {
+	a, err := o.newAPI()
+	if err != nil {
+		return err
+	}
+
+	if a.client == nil {
+		return errors.New("a server URL is required to match phashes")
+	}
+
+	matches, err := a.findPhashDuplicates()
+	if err != nil {
+		return err
+	}
+
+	for _, m := range matches {
+		if m.spriteScore != 0 {
+			fmt.Printf("%s - %s [phash distance %d, score %.f]\n", m.subject, m.other, m.distance, -m.spriteScore)
+		} else {
+			fmt.Printf("%s - %s [phash distance %d]\n", m.subject, m.other, m.distance)
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "Writing phash matches to %s\n", o.output)
+	if o.output == "-" {
+		return writePhashCSVReport(os.Stdout, matches, a.cache)
+	}
+
+	f, err := os.Create(o.output)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return writePhashCSVReport(f, matches, a.cache)
+}
+
+func cmdMarkers(o *cmdOptions, args []string) error {
+	a, err := o.newAPI()
+	if err != nil {
+		return err
+	}
+
+	if a.client == nil {
+		return errors.New("a server URL is required to sync markers")
+	}
+
+	if a.markerTagID == nil {
+		return errors.New("marker_tag_name must be set to sync duplicate markers")
+	}
+
+	err = a.syncStoredMarkers(nil)
+	a.logFailures()
+	return err
+}
+
+func cmdVerifyDB(o *cmdOptions, args []string) error {
+	cfg, err := o.loadConfig()
+	if err != nil {
+		return err
+	}
+
+	store, err := verifyDB(cfg.DBFilename)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Database OK: %d hashes\n", store.Size())
+
+	matches, err := readMatches(cfg.MatchesFilename)
+	if err != nil {
+		return fmt.Errorf("error reading matches file: %s", err.Error())
+	}
+
+	problems := 0
+	for _, m := range matches {
+		for _, id := range []string{m.Subject, m.Other} {
+			if !store.Has(id) {
+				fmt.Printf("Match %s - %s: %s is not in the database\n", m.Subject, m.Other, id)
+				problems++
 			}
-			time.Sleep(5 * time.Second)
 		}
 	}
+
+	if problems > 0 {
+		return fmt.Errorf("%d problems found in matches file. Run scan or prune to correct", problems)
+	}
+
+	fmt.Printf("Matches OK: %d matches\n", len(matches))
+	return nil
+}
+
+func cmdStats(o *cmdOptions, args []string) error {
+	cfg, err := o.loadConfig()
+	if err != nil {
+		return err
+	}
+
+	store := duplo.New()
+	if err := readDB(store, cfg.DBFilename); err != nil {
+		return fmt.Errorf("error reading database: %s", err.Error())
+	}
+
+	matches, err := readMatches(cfg.MatchesFilename)
+	if err != nil {
+		return fmt.Errorf("error reading matches file: %s", err.Error())
+	}
+
+	meta, err := readMeta(cfg.MetaFilename)
+	if err != nil {
+		return fmt.Errorf("error reading meta file: %s", err.Error())
+	}
+
+	lowInformation := 0
+	for _, m := range meta {
+		if m.LowInformation {
+			lowInformation++
+		}
+	}
+
+	fmt.Printf("Hashes: %d\n", store.Size())
+	if lowInformation > 0 {
+		fmt.Printf("Excluded low information sprites: %d\n", lowInformation)
+	}
+	fmt.Printf("Matches: %d\n", len(matches))
+	if partial := len(matches.filter(func(m *matchResult) bool { return m.Partial })); partial > 0 {
+		fmt.Printf("Partial matches: %d\n", partial)
+	}
+
+	if len(matches) == 0 {
+		return nil
+	}
+
+	duplicates := make(map[string]bool)
+	var scores []float64
+	for _, m := range matches {
+		duplicates[m.Subject] = true
+		duplicates[m.Other] = true
+		scores = append(scores, -m.Score)
+	}
+	sort.Float64s(scores)
+
+	total := 0.0
+	for _, s := range scores {
+		total += s
+	}
+
+	fmt.Printf("Sprites with duplicates: %d\n", len(duplicates))
+	fmt.Printf("Score: min %.f, median %.f, mean %.f, max %.f\n", scores[0], scores[len(scores)/2], total/float64(len(scores)), scores[len(scores)-1])
+	return nil
 }
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+
+	"github.com/rivo/duplo"
+)
+
+// ruleResult is the result of a single matching rule for a pair of sprites.
+type ruleResult struct {
+	name   string
+	passed bool
+	detail string
+}
+
+// comparison contains the details of comparing two sprites.
+type comparison struct {
+	// match is nil if the sprites have no similarity at all
+	match *duplo.Match
+
+	// mirrored is true if match is the match of the mirrored sprite
+	mirrored bool
+
+	// meta and otherMeta are the details detected when preparing the
+	// sprites, if any
+	meta      *spriteMeta
+	otherMeta *spriteMeta
+
+	// tileDistances contains the hamming distance between the hashes of each
+	// pair of corresponding tiles, in row order
+	tileDistances []int
+	cols          int
+
+	// skipped contains the indexes of the tiles that are uninformative or
+	// part of an intro in either sprite
+	skipped map[int]bool
+
+	// segments are the matching parts of the scenes, if the VTT files of
+	// both sprites exist
+	segments []matchSegment
+
+	rules []ruleResult
+}
+
+// matched returns true if all rules passed.
+func (c *comparison) matched() bool {
+	for _, r := range c.rules {
+		if !r.passed {
+			return false
+		}
+	}
+
+	return len(c.rules) > 0
+}
+
+// compareSprites compares the sprite files, prepared using the options of
+// each sprite.
+func (a *api) compareSprites(fn, otherFn string) (*comparison, error) {
+	cfg := a.cfg
+
+	img, err := readSprite(fn)
+	if err != nil {
+		return nil, err
+	}
+
+	otherImg, err := readSprite(otherFn)
+	if err != nil {
+		return nil, err
+	}
+
+	img, meta := prepareSprite(img, a.hashOptions(getChecksum(fn)))
+	otherImg, otherMeta := prepareSprite(otherImg, a.hashOptions(getChecksum(otherFn)))
+
+	hash, _ := duplo.CreateHash(img)
+	otherHash, _ := duplo.CreateHash(otherImg)
+
+	store := duplo.New()
+	store.Add(otherFn, otherHash)
+
+	ret := &comparison{
+		cols:      spriteGridSize,
+		meta:      meta,
+		otherMeta: otherMeta,
+	}
+
+	matches := store.Query(hash)
+	if len(matches) > 0 {
+		ret.match = matches[0]
+	}
+
+	if cfg.MatchMirrored {
+		mirroredImg := mirrorTiles(img, spriteGridSize, spriteGridSize)
+		mirroredHash, _ := duplo.CreateHash(mirroredImg)
+		matches := store.Query(mirroredHash)
+		if len(matches) > 0 && (ret.match == nil || matches[0].Score < ret.match.Score) {
+			ret.match = matches[0]
+			ret.mirrored = true
+			img = mirroredImg
+		}
+	}
+
+	vtt, err := readVTT(getVTTFilename(filepath.Dir(fn), getChecksum(fn)))
+	if err == nil {
+		otherVTT, err := readVTT(getVTTFilename(filepath.Dir(otherFn), getChecksum(otherFn)))
+		if err == nil {
+			ret.segments = timeSegments(alignTiles(spriteTileHashes(img), spriteTileHashes(otherImg)), vtt, otherVTT)
+		}
+	}
+
+	tiles := spriteTiles(img, spriteGridSize, spriteGridSize)
+	otherTiles := spriteTiles(otherImg, spriteGridSize, spriteGridSize)
+	for i := range tiles {
+		if i < len(otherTiles) {
+			ret.tileDistances = append(ret.tileDistances, hammingDistance(tileHash(tiles[i]), tileHash(otherTiles[i])))
+		}
+	}
+
+	ret.rules = cfg.rules(ret.match)
+
+	ret.skipped = make(map[int]bool)
+	for _, m := range []*spriteMeta{meta, otherMeta} {
+		if m == nil {
+			continue
+		}
+
+		for _, i := range append(append([]int{}, m.UninformativeTiles...), m.IntroTiles...) {
+			ret.skipped[i] = true
+		}
+	}
+
+	if cfg.SkipUninformativeTiles {
+		n, low := informativeTiles(meta)
+		otherN, otherLow := informativeTiles(otherMeta)
+		ret.rules = append(ret.rules, ruleResult{
+			name:   "informative tiles",
+			passed: !low && !otherLow,
+			detail: fmt.Sprintf("%d and %d >= %d", n, otherN, cfg.MinInformativeTiles),
+		})
+	}
+
+	return ret, nil
+}
+
+// informativeTiles returns the number of informative tiles of the sprite,
+// and whether it has too few to be matched. Sprites without metadata have no
+// usable tiles.
+func informativeTiles(m *spriteMeta) (int, bool) {
+	if m == nil {
+		return 0, true
+	}
+
+	return m.informativeTiles(), m.LowInformation
+}
+
+// heatMapChars are used to show tile similarity, from most to least similar.
+var heatMapChars = []string{"██", "▓▓", "▒▒", "░░", "  "}
+
+func heatMapChar(distance int) string {
+	// distances range from 0 to 64. Unrelated images are around 32.
+	i := distance / 6
+	if i >= len(heatMapChars) {
+		i = len(heatMapChars) - 1
+	}
+
+	return heatMapChars[i]
+}
+
+func (c *comparison) print(w io.Writer) {
+	if c.match == nil {
+		fmt.Fprintln(w, "No similarity found")
+	} else {
+		fmt.Fprintf(w, "Score:              %.f\n", -c.match.Score)
+		fmt.Fprintf(w, "Ratio difference:   %.4f\n", c.match.RatioDiff)
+		fmt.Fprintf(w, "dHash distance:     %d\n", c.match.DHashDistance)
+		fmt.Fprintf(w, "Histogram distance: %d\n", c.match.HistogramDistance)
+		if c.mirrored {
+			fmt.Fprintln(w, "Mirrored:           yes")
+		}
+	}
+
+	if c.meta != nil && c.otherMeta != nil && c.meta.Content != nil && c.otherMeta.Content != nil {
+		fmt.Fprintf(w, "Content:            %dx%d (%.2f) and %dx%d (%.2f)\n",
+			c.meta.Content.Width, c.meta.Content.Height, c.meta.aspectRatio(),
+			c.otherMeta.Content.Width, c.otherMeta.Content.Height, c.otherMeta.aspectRatio())
+	}
+
+	if c.meta != nil && c.otherMeta != nil && len(c.meta.IntroTiles)+len(c.otherMeta.IntroTiles) > 0 {
+		fmt.Fprintf(w, "Intro tiles:        %d and %d\n", len(c.meta.IntroTiles), len(c.otherMeta.IntroTiles))
+	}
+
+	for i, s := range c.segments {
+		label := ""
+		if i == 0 {
+			label = "Segments:"
+		}
+		fmt.Fprintf(w, "%-20s%s\n", label, s)
+	}
+
+	if len(c.tileDistances) > 0 {
+		fmt.Fprintln(w)
+		fmt.Fprintln(w, "Tile similarity (hamming distance of each tile, 0 is identical):")
+		for i, d := range c.tileDistances {
+			if c.skipped[i] {
+				fmt.Fprint(w, "··")
+			} else {
+				fmt.Fprint(w, heatMapChar(d))
+			}
+			if (i+1)%c.cols == 0 {
+				fmt.Fprint(w, "   ")
+				for j := i + 1 - c.cols; j <= i; j++ {
+					if c.skipped[j] {
+						fmt.Fprint(w, "  -")
+					} else {
+						fmt.Fprintf(w, "%3d", c.tileDistances[j])
+					}
+				}
+				fmt.Fprintln(w)
+			}
+		}
+	}
+
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Rules:")
+	for _, r := range c.rules {
+		result := "FAIL"
+		if r.passed {
+			result = "pass"
+		}
+		fmt.Fprintf(w, "  %-4s %s: %s\n", result, r.name, r.detail)
+	}
+
+	if c.matched() {
+		fmt.Fprintln(w, "Match: yes")
+	} else {
+		fmt.Fprintln(w, "Match: no")
+	}
+}
@@ -1,23 +1,147 @@
 package main
 
 import (
+	"fmt"
 	"os"
+	"time"
+
+	"stash-plugin-duplicate-finder/internal/plugin/util"
 
 	"gopkg.in/yaml.v2"
 )
 
 type config struct {
 	DBFilename string `yaml:"db_filename"`
-	Threshold  int    `yaml:"threshold"`
 	AddTagName string `yaml:"add_tag_name"`
 	AddDetails bool   `yaml:"add_details"`
 	NewOnly    bool   `yaml:"new_only"`
+
+	// MarkerTagName is the primary tag of the markers created at the
+	// matching segments of duplicates. No markers are created if empty.
+	MarkerTagName string `yaml:"marker_tag_name"`
+
+	matchCriteria `yaml:",inline"`
+	MatchMirrored bool `yaml:"match_mirrored"`
+	CropBorders   bool `yaml:"crop_borders"`
+
+	// regions excluded from hashing
+	Masks       []maskRect            `yaml:"masks"`
+	StudioMasks map[string][]maskRect `yaml:"studio_masks"`
+	AutoMask    bool                  `yaml:"auto_mask"`
+
+	SkipUninformativeTiles bool `yaml:"skip_uninformative_tiles"`
+	MinInformativeTiles    int  `yaml:"min_informative_tiles"`
+
+	// intro and outro detection options
+	ExcludeIntros  bool   `yaml:"exclude_intros"`
+	IntrosFilename string `yaml:"intros_filename"`
+	MaxIntroTiles  int    `yaml:"max_intro_tiles"`
+	MinIntroScenes int    `yaml:"min_intro_scenes"`
+
+	// duration criteria. MaxDurationDiff is the maximum difference between
+	// the durations of whole scene duplicates, as a percentage of the longer
+	// duration. 0 disables the limit.
+	MaxDurationDiff float64 `yaml:"max_duration_diff"`
+	DurationScoring bool    `yaml:"duration_scoring"`
+
+	// image mode options. MinGalleryOverlap is the minimum percentage of
+	// the images of the smaller of two galleries that must be shared for
+	// them to overlap.
+	ImagesDBFilename     string  `yaml:"images_db_filename"`
+	ImageMatchesFilename string  `yaml:"image_matches_filename"`
+	MinGalleryOverlap    float64 `yaml:"min_gallery_overlap"`
+
+	// phash mode options. MaxPhashDistance is the maximum hamming distance
+	// between the phashes of duplicates.
+	MaxPhashDistance int  `yaml:"max_phash_distance"`
+	CombinePhash     bool `yaml:"combine_phash"`
+
+	MatchesFilename   string `yaml:"matches_filename"`
+	DecisionsFilename string `yaml:"decisions_filename"`
+	MetaFilename      string `yaml:"meta_filename"`
+	Workers           int    `yaml:"workers"`
+
+	ExportFilename string `yaml:"export_filename"`
+	ExportFormat   string `yaml:"export_format"`
+
+	// connection options
+	APIKey             string `yaml:"api_key"`
+	CACert             string `yaml:"ca_cert"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+	Timeout            int    `yaml:"timeout"`
+
+	// retry and rate limit options
+	MaxRetries        int     `yaml:"max_retries"`
+	RetryBackoff      int     `yaml:"retry_backoff"`
+	RequestsPerSecond float64 `yaml:"requests_per_second"`
+}
+
+func (c config) clientOptions() util.ClientOptions {
+	return util.ClientOptions{
+		APIKey:             c.APIKey,
+		CACertFile:         c.CACert,
+		InsecureSkipVerify: c.InsecureSkipVerify,
+		Timeout:            time.Duration(c.Timeout) * time.Second,
+		MaxRetries:         c.MaxRetries,
+		RetryBackoff:       time.Duration(c.RetryBackoff) * time.Millisecond,
+		RequestsPerSecond:  c.RequestsPerSecond,
+	}
+}
+
+func (c config) hashOptions() spriteHashOptions {
+	return spriteHashOptions{
+		mirrored:    c.MatchMirrored,
+		cropBorders: c.CropBorders,
+		masks:       c.Masks,
+		autoMask:    c.AutoMask,
+
+		skipUninformative:   c.SkipUninformativeTiles,
+		minInformativeTiles: c.MinInformativeTiles,
+	}
+}
+
+func (c config) validateMasks() error {
+	for _, m := range c.Masks {
+		if err := m.validate(); err != nil {
+			return err
+		}
+	}
+
+	for studio, masks := range c.StudioMasks {
+		for _, m := range masks {
+			if err := m.validate(); err != nil {
+				return fmt.Errorf("studio %s: %s", studio, err.Error())
+			}
+		}
+	}
+
+	return nil
 }
 
 func readConfig(fn string) (*config, error) {
 	ret := &config{
-		DBFilename: "df-hashstore.db",
-		Threshold:  50,
+		DBFilename:        "df-hashstore.db",
+		MatchesFilename:   "df-matches.json",
+		DecisionsFilename: "df-decisions.json",
+		MetaFilename:      "df-meta.json",
+		IntrosFilename:    "df-intros.json",
+
+		ImagesDBFilename:     "df-images.db",
+		ImageMatchesFilename: "df-image-matches.json",
+		MinGalleryOverlap:    80,
+
+		MaxPhashDistance: 4,
+
+		matchCriteria: matchCriteria{
+			Threshold: 50,
+		},
+		MinInformativeTiles: 20,
+		MaxIntroTiles:       3,
+		MinIntroScenes:      5,
+		Workers:             1,
+		ExportFormat:        reportFormatJSON,
+		MaxRetries:          3,
+		RetryBackoff:        500,
 	}
 
 	_, err := os.Stat(fn)
@@ -42,6 +166,10 @@ func readConfig(fn string) (*config, error) {
 		return nil, err
 	}
 
+	if err := ret.validateMasks(); err != nil {
+		return nil, err
+	}
+
 	return ret, nil
 }
 
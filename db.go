@@ -1,7 +1,8 @@
 package main
 
 import (
-	"image/jpeg"
+	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"sort"
@@ -17,12 +18,7 @@ func storeDB(store *duplo.Store, filename string) error {
 		return err
 	}
 
-	err = ioutil.WriteFile(filename, data, 0644)
-	if err != nil {
-		return err
-	}
-
-	return nil
+	return writeFileAtomic(filename, data)
 }
 
 func readDB(store *duplo.Store, filename string) error {
@@ -30,6 +26,7 @@ func readDB(store *duplo.Store, filename string) error {
 	if err != nil {
 		// assume no file
 		log.Info("Assuming no existing db file. Starting from scratch...")
+		return nil
 	}
 
 	err = store.GobDecode(data)
@@ -41,22 +38,198 @@ func readDB(store *duplo.Store, filename string) error {
 	return nil
 }
 
-func getImageHash(fn string) (*duplo.Hash, error) {
-	f, err := os.Open(fn)
+// verifyDB reads the store from filename, returning an error if the file
+// does not exist or cannot be decoded.
+func verifyDB(filename string) (*duplo.Store, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	store := duplo.New()
+	if err := store.GobDecode(data); err != nil {
+		return nil, fmt.Errorf("error decoding database: %s", err.Error())
+	}
+
+	for _, id := range store.IDs() {
+		if _, ok := id.(string); !ok {
+			return nil, fmt.Errorf("invalid id in database: %v", id)
+		}
+	}
+
+	return store, nil
+}
+
+func storeMatches(matches matchResults, filename string) error {
+	if matches == nil {
+		matches = matchResults{}
+	}
+
+	data, err := json.MarshalIndent(matches, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(filename, data)
+}
+
+func readMatches(filename string) (matchResults, error) {
+	data, err := ioutil.ReadFile(filename)
 	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+
 		return nil, err
 	}
 
-	img, err := jpeg.Decode(f)
+	var ret matchResults
+	if err := json.Unmarshal(data, &ret); err != nil {
+		return nil, err
+	}
+
+	return ret, nil
+}
+
+func storeMeta(meta spriteMetas, filename string) error {
+	data, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(filename, data)
+}
+
+// prune removes the metadata of sprites that are not in the store. The
+// metadata of low information sprites, which are not stored, is kept while
+// the sprite file exists in path.
+func (m spriteMetas) prune(path string, store *duplo.Store) {
+	for name, meta := range m {
+		if store.Has(name) {
+			continue
+		}
+
+		if meta.LowInformation {
+			if _, err := os.Stat(getSpriteFilename(path, name)); err == nil {
+				continue
+			}
+		}
+
+		delete(m, name)
+	}
+}
+
+// readMeta reads the sprite metadata file. It returns empty metadata if the
+// file does not exist.
+func readMeta(filename string) (spriteMetas, error) {
+	ret := make(spriteMetas)
+	data, err := ioutil.ReadFile(filename)
 	if err != nil {
+		if os.IsNotExist(err) {
+			return ret, nil
+		}
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, &ret); err != nil {
 		return nil, err
 	}
 
+	return ret, nil
+}
+
+func storeDecisions(d decisions, filename string) error {
+	var list []*pairDecision
+	for _, pd := range d {
+		list = append(list, pd)
+	}
+
+	// sort for stable output
+	sort.Slice(list, func(i, j int) bool {
+		return pairKey(list[i].Subject, list[i].Other) < pairKey(list[j].Subject, list[j].Other)
+	})
+
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(filename, data)
+}
+
+func readDecisions(filename string) (decisions, error) {
+	ret := make(decisions)
+
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return ret, nil
+		}
+
+		return nil, err
+	}
+
+	var list []*pairDecision
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, err
+	}
+
+	for _, pd := range list {
+		ret.set(pd.Subject, pd.Other, pd.Decision, pd.Keep)
+	}
+
+	return ret, nil
+}
+
+// spriteHashes contains the hashes of a sprite file.
+type spriteHashes struct {
+	hash duplo.Hash
+
+	// mirroredHash is the hash of the sprite with its tiles mirrored
+	// horizontally. It is nil if mirrored matching is disabled.
+	mirroredHash *duplo.Hash
+
+	// meta is nil if no metadata was detected
+	meta *spriteMeta
+
+	// tileHashes are the hashes of each tile of the prepared sprite, and
+	// mirroredTileHashes of the mirrored sprite if mirrored matching is
+	// enabled. They are nil unless requested by the hash options.
+	tileHashes         []uint64
+	mirroredTileHashes []uint64
+}
+
+// getImageHashes returns the hashes of the sprite file, prepared using the
+// options.
+func getImageHashes(fn string, o spriteHashOptions) (*spriteHashes, error) {
+	img, err := readSprite(fn)
+	if err != nil {
+		return nil, err
+	}
+
+	img, meta := prepareSprite(img, o)
 	hash, _ := duplo.CreateHash(img)
-	return &hash, nil
+	ret := &spriteHashes{
+		hash: hash,
+		meta: meta,
+	}
+	if o.tileHashes {
+		ret.tileHashes = spriteTileHashes(img)
+	}
+
+	if o.mirrored {
+		mirrored := mirrorTiles(img, spriteGridSize, spriteGridSize)
+		mirroredHash, _ := duplo.CreateHash(mirrored)
+		ret.mirroredHash = &mirroredHash
+		if o.tileHashes {
+			ret.mirroredTileHashes = spriteTileHashes(mirrored)
+		}
+	}
+
+	return ret, nil
 }
 
-func getHashMatches(store *duplo.Store, checksum string, hash duplo.Hash, threshold int) duplo.Matches {
+func getHashMatches(store *duplo.Store, checksum string, hash duplo.Hash, criteria matchCriteria) duplo.Matches {
 	ret := duplo.Matches{}
 
 	matches := store.Query(hash)
@@ -68,10 +241,41 @@ func getHashMatches(store *duplo.Store, checksum string, hash duplo.Hash, thresh
 			continue
 		}
 
-		if m.Score <= float64(-threshold) {
+		if criteria.isMatch(m) {
 			ret = append(ret, m)
 		}
 	}
 
 	return ret
 }
+
+// mergeMirroredMatches adds the matches of the mirrored hash to the matches,
+// replacing matches of the same sprite with a worse score. It returns the
+// merged matches, sorted by score, and the ids of the sprites matched by the
+// mirrored hash.
+func mergeMirroredMatches(matches, mirroredMatches duplo.Matches) (duplo.Matches, map[string]bool) {
+	mirrored := make(map[string]bool)
+	byID := make(map[string]int)
+	for i, m := range matches {
+		byID[m.ID.(string)] = i
+	}
+
+	for _, m := range mirroredMatches {
+		id := m.ID.(string)
+		i, found := byID[id]
+		switch {
+		case !found:
+			byID[id] = len(matches)
+			matches = append(matches, m)
+		case m.Score < matches[i].Score:
+			matches[i] = m
+		default:
+			continue
+		}
+
+		mirrored[id] = true
+	}
+
+	sort.Sort(matches)
+	return matches, mirrored
+}
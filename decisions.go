@@ -0,0 +1,66 @@
+package main
+
+// Valid review decisions
+const (
+	decisionDuplicate    = "duplicate"
+	decisionNotDuplicate = "not_duplicate"
+)
+
+// pairDecision is the result of a manual review of a match.
+type pairDecision struct {
+	Subject  string `json:"subject"`
+	Other    string `json:"other"`
+	Decision string `json:"decision"`
+
+	// Keep is the sprite name of the copy to keep, if chosen
+	Keep string `json:"keep,omitempty"`
+}
+
+// decisions contains the review decisions, keyed by pair.
+type decisions map[string]*pairDecision
+
+func pairKey(a, b string) string {
+	if a > b {
+		a, b = b, a
+	}
+
+	return a + "|" + b
+}
+
+func (d decisions) get(a, b string) *pairDecision {
+	return d[pairKey(a, b)]
+}
+
+// set records the decision for the pair. An empty decision removes any
+// existing decision.
+func (d decisions) set(a, b, decision, keep string) {
+	if decision == "" {
+		delete(d, pairKey(a, b))
+		return
+	}
+
+	d[pairKey(a, b)] = &pairDecision{
+		Subject:  a,
+		Other:    b,
+		Decision: decision,
+		Keep:     keep,
+	}
+}
+
+// isIgnored returns true if the pair was reviewed as not being duplicates.
+func (d decisions) isIgnored(a, b string) bool {
+	pd := d.get(a, b)
+	return pd != nil && pd.Decision == decisionNotDuplicate
+}
+
+// isKeeper returns true if the sprite was chosen to be kept in any of its
+// reviewed pairs.
+func (d decisions) isKeeper(name string) bool {
+	for _, pd := range d {
+		if pd.Keep == name {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"math"
+
+	"stash-plugin-duplicate-finder/internal/plugin/common/log"
+
+	"github.com/rivo/duplo"
+)
+
+// spriteDuration returns the duration of the scene of the sprite in seconds,
+// or 0 if it is not known. The duration is taken from stash if connected,
+// otherwise from the VTT file of the sprite, and is stored in the sprite
+// metadata.
+func (a *api) spriteDuration(path, name string) float64 {
+	m := a.meta[name]
+	if m != nil && m.Duration > 0 {
+		return m.Duration
+	}
+
+	ret := 0.0
+	if a.cache != nil {
+		if s, err := a.cache.get(name); err == nil && s.File.Duration != nil {
+			ret = float64(*s.File.Duration)
+		}
+	}
+
+	if ret == 0 {
+		vtt, err := readVTT(getVTTFilename(path, name))
+		if err != nil {
+			log.Debugf("Duration of %s not known: %s", name, err.Error())
+			return 0
+		}
+		ret = vtt.duration()
+	}
+
+	if ret > 0 && a.meta != nil {
+		if m == nil {
+			m = &spriteMeta{}
+			a.meta[name] = m
+		}
+		m.Duration = ret
+	}
+
+	return ret
+}
+
+// durationRatio returns the ratio of the shorter duration to the longer, or
+// 0 if either duration is not known.
+func durationRatio(duration, otherDuration float64) float64 {
+	if duration <= 0 || otherDuration <= 0 {
+		return 0
+	}
+
+	return math.Min(duration, otherDuration) / math.Max(duration, otherDuration)
+}
+
+// filterDurations applies the duration criteria to the matches of the
+// subject, which must have been aligned. Matches whose durations differ by
+// more than max_duration_diff are partial matches if they have matching
+// segments, and are removed otherwise. If duration scoring is enabled, the
+// scores of the other matches are scaled by the ratio of the durations and
+// recorded as their duration scores, and matches whose duration scores do not
+// reach the threshold are removed. The match scores are not changed. Matches
+// where either duration is not known are kept unchanged.
+func (a *api) filterDurations(path, checksum string, matches duplo.Matches) duplo.Matches {
+	if a.cfg.MaxDurationDiff <= 0 && !a.cfg.DurationScoring {
+		return matches
+	}
+
+	if a.partial == nil {
+		a.partial = make(map[string]bool)
+	}
+	if a.durationScores == nil {
+		a.durationScores = make(map[string]float64)
+	}
+
+	duration := a.spriteDuration(path, checksum)
+
+	var ret duplo.Matches
+	for _, m := range matches {
+		other := m.ID.(string)
+		key := pairKey(checksum, other)
+		a.partial[key] = false
+		a.durationScores[key] = 0
+
+		ratio := durationRatio(duration, a.spriteDuration(path, other))
+		if ratio == 0 {
+			ret = append(ret, m)
+			continue
+		}
+
+		if a.cfg.MaxDurationDiff > 0 && (1-ratio)*100 > a.cfg.MaxDurationDiff {
+			if len(a.segments[checksum+"|"+other]) == 0 {
+				log.Debugf("Excluding %s - %s: durations differ by %.f%%", checksum, other, (1-ratio)*100)
+				continue
+			}
+
+			a.partial[key] = true
+			ret = append(ret, m)
+			continue
+		}
+
+		if a.cfg.DurationScoring {
+			score := m.Score * ratio
+			if score > float64(-a.cfg.Threshold) {
+				log.Debugf("Excluding %s - %s: score %.f with duration ratio %.2f is below threshold", checksum, other, -score, ratio)
+				continue
+			}
+			a.durationScores[key] = score
+		}
+
+		ret = append(ret, m)
+	}
+
+	return ret
+}
@@ -1,10 +1,10 @@
 module stash-plugin-duplicate-finder
 
-go 1.11
+go 1.13
 
 require (
 	github.com/natefinch/pie v0.0.0-20170715172608-9a0d72014007
-	github.com/nfnt/resize v0.0.0-20180221191011-83c6a9932646 // indirect
+	github.com/nfnt/resize v0.0.0-20180221191011-83c6a9932646
 	github.com/rivo/duplo v0.0.0-20180323201418-c4ec823d58cd
 	github.com/shurcooL/graphql v0.0.0-20181231061246-d48a9a75455f
 	golang.org/x/net v0.0.0-20200707034311-ab3426394381 // indirect
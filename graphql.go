@@ -13,12 +13,65 @@ type Tag struct {
 	Name graphql.String `graphql:"name"`
 }
 
+type Studio struct {
+	ID   graphql.ID     `graphql:"id"`
+	Name graphql.String `graphql:"name"`
+}
+
+type SceneFile struct {
+	Size     *graphql.String
+	Duration *graphql.Float
+	Width    *graphql.Int
+	Height   *graphql.Int
+}
+
+// durationString returns the duration in seconds, or an empty string if not
+// known.
+func (f SceneFile) durationString() string {
+	if f.Duration == nil {
+		return ""
+	}
+
+	return fmt.Sprintf("%.2f", float64(*f.Duration))
+}
+
+// resolutionString returns the resolution in the form WIDTHxHEIGHT, or an
+// empty string if not known.
+func (f SceneFile) resolutionString() string {
+	if f.Width == nil || f.Height == nil {
+		return ""
+	}
+
+	return fmt.Sprintf("%dx%d", *f.Width, *f.Height)
+}
+
 type Scene struct {
-	ID      graphql.ID
-	Title   *graphql.String
-	Path    graphql.String
-	Details *graphql.String
-	Tags    []Tag
+	ID       graphql.ID
+	Checksum *graphql.String
+	Oshash   *graphql.String
+	Title    *graphql.String
+	Path     graphql.String
+	Details  *graphql.String
+	File     SceneFile
+	Tags     []Tag
+	Studio   *Studio
+}
+
+// getHash returns the hash used to name the generated files of the scene,
+// based on the provided video file naming algorithm.
+func (s Scene) getHash(algorithm string) string {
+	var ret *graphql.String
+	if algorithm == hashAlgorithmOshash {
+		ret = s.Oshash
+	} else {
+		ret = s.Checksum
+	}
+
+	if ret == nil {
+		return ""
+	}
+
+	return string(*ret)
 }
 
 func (s Scene) getTagIds() []graphql.ID {
@@ -31,10 +84,20 @@ func (s Scene) getTagIds() []graphql.ID {
 	return ret
 }
 
+// Valid values of the video file naming algorithm
+const (
+	hashAlgorithmMD5    = "MD5"
+	hashAlgorithmOshash = "OSHASH"
+)
+
 type ConfigGeneralResult struct {
 	GeneratedPath graphql.String `graphql:"generatedPath"`
 }
 
+type ConfigNamingResult struct {
+	VideoFileNamingAlgorithm graphql.String `graphql:"videoFileNamingAlgorithm"`
+}
+
 type ConfigResult struct {
 	General ConfigGeneralResult `graphql:"general"`
 }
@@ -53,6 +116,21 @@ func getSpriteDir(client *graphql.Client) (string, error) {
 	return ret, nil
 }
 
+func getVideoFileNamingAlgorithm(client *graphql.Client) (string, error) {
+	var m struct {
+		Configuration struct {
+			General ConfigNamingResult `graphql:"general"`
+		} `graphql:"configuration"`
+	}
+
+	err := client.Query(context.Background(), &m, nil)
+	if err != nil {
+		return "", fmt.Errorf("Error getting video file naming algorithm from configuration: %s", err.Error())
+	}
+
+	return string(m.Configuration.General.VideoFileNamingAlgorithm), nil
+}
+
 func addTagId(tagIds []graphql.ID, tagId graphql.ID) []graphql.ID {
 	for _, t := range tagIds {
 		if t == tagId {
@@ -81,6 +159,96 @@ func findSceneFromChecksum(client *graphql.Client, checksum string) (*Scene, err
 	return m.FindScene, nil
 }
 
+func findSceneFromID(client *graphql.Client, id string) (*Scene, error) {
+	var m struct {
+		FindScene *Scene `graphql:"findScene(id: $id)"`
+	}
+
+	vars := map[string]interface{}{
+		"id": graphql.ID(id),
+	}
+
+	err := client.Query(context.Background(), &m, vars)
+	if err != nil {
+		return nil, err
+	}
+
+	return m.FindScene, nil
+}
+
+type FindFilterType struct {
+	Page    *graphql.Int `graphql:"page" json:"page"`
+	PerPage *graphql.Int `graphql:"per_page" json:"per_page"`
+}
+
+type FindScenesResultType struct {
+	Count  graphql.Int
+	Scenes []Scene
+}
+
+// findScenes returns a page of scenes. Page numbers start at 1.
+func findScenes(client *graphql.Client, page, perPage int) (*FindScenesResultType, error) {
+	var m struct {
+		FindScenes FindScenesResultType `graphql:"findScenes(filter: $f)"`
+	}
+
+	vars := map[string]interface{}{
+		"f": &FindFilterType{
+			Page:    graphql.NewInt(graphql.Int(page)),
+			PerPage: graphql.NewInt(graphql.Int(perPage)),
+		},
+	}
+
+	err := client.Query(context.Background(), &m, vars)
+	if err != nil {
+		return nil, err
+	}
+
+	return &m.FindScenes, nil
+}
+
+// ScenePhash contains the hashes of a scene, including the perceptual hash
+// of its video generated by stash. Phash is nil if it has not been
+// generated.
+type ScenePhash struct {
+	ID       graphql.ID
+	Checksum *graphql.String
+	Oshash   *graphql.String
+	Phash    *graphql.String
+}
+
+// getHash returns the hash used to name the generated files of the scene,
+// based on the provided video file naming algorithm.
+func (s ScenePhash) getHash(algorithm string) string {
+	return Scene{Checksum: s.Checksum, Oshash: s.Oshash}.getHash(algorithm)
+}
+
+type FindScenePhashesResultType struct {
+	Count  graphql.Int
+	Scenes []ScenePhash
+}
+
+// findScenePhashes returns a page of scene hashes. Page numbers start at 1.
+func findScenePhashes(client *graphql.Client, page, perPage int) (*FindScenePhashesResultType, error) {
+	var m struct {
+		FindScenes FindScenePhashesResultType `graphql:"findScenes(filter: $f)"`
+	}
+
+	vars := map[string]interface{}{
+		"f": &FindFilterType{
+			Page:    graphql.NewInt(graphql.Int(page)),
+			PerPage: graphql.NewInt(graphql.Int(perPage)),
+		},
+	}
+
+	err := client.Query(context.Background(), &m, vars)
+	if err != nil {
+		return nil, err
+	}
+
+	return &m.FindScenes, nil
+}
+
 type SceneHashInput struct {
 	Oshash *graphql.String `graphql:"oshash" json:"oshash"`
 }
@@ -144,6 +312,184 @@ func updateScene(client *graphql.Client, s Scene, details string, duplicateTagID
 	return nil
 }
 
+type Gallery struct {
+	ID    graphql.ID      `graphql:"id"`
+	Title *graphql.String `graphql:"title"`
+}
+
+type Image struct {
+	ID        graphql.ID
+	Checksum  *graphql.String
+	Path      graphql.String
+	Galleries []Gallery
+}
+
+type FindImagesResultType struct {
+	Count  graphql.Int
+	Images []Image
+}
+
+// findImages returns a page of images. Page numbers start at 1.
+func findImages(client *graphql.Client, page, perPage int) (*FindImagesResultType, error) {
+	var m struct {
+		FindImages FindImagesResultType `graphql:"findImages(filter: $f)"`
+	}
+
+	vars := map[string]interface{}{
+		"f": &FindFilterType{
+			Page:    graphql.NewInt(graphql.Int(page)),
+			PerPage: graphql.NewInt(graphql.Int(perPage)),
+		},
+	}
+
+	err := client.Query(context.Background(), &m, vars)
+	if err != nil {
+		return nil, err
+	}
+
+	return &m.FindImages, nil
+}
+
+// addImageTag adds the tag to the images.
+func addImageTag(client *graphql.Client, ids []graphql.ID, tagID graphql.ID) error {
+	var m struct {
+		BulkImageUpdate []struct {
+			ID graphql.ID `graphql:"id"`
+		} `graphql:"bulkImageUpdate(input: {ids: $ids, tag_ids: $tag_ids})"`
+	}
+
+	vars := map[string]interface{}{
+		"ids": ids,
+		"tag_ids": &BulkUpdateIds{
+			IDs:  []graphql.ID{tagID},
+			Mode: "ADD",
+		},
+	}
+
+	return client.Mutate(context.Background(), &m, vars)
+}
+
+// addGalleryTag adds the tag to the galleries.
+func addGalleryTag(client *graphql.Client, ids []graphql.ID, tagID graphql.ID) error {
+	var m struct {
+		BulkGalleryUpdate []struct {
+			ID graphql.ID `graphql:"id"`
+		} `graphql:"bulkGalleryUpdate(input: {ids: $ids, tag_ids: $tag_ids})"`
+	}
+
+	vars := map[string]interface{}{
+		"ids": ids,
+		"tag_ids": &BulkUpdateIds{
+			IDs:  []graphql.ID{tagID},
+			Mode: "ADD",
+		},
+	}
+
+	return client.Mutate(context.Background(), &m, vars)
+}
+
+type SceneMarker struct {
+	ID         graphql.ID     `graphql:"id"`
+	Title      graphql.String `graphql:"title"`
+	Seconds    graphql.Float  `graphql:"seconds"`
+	PrimaryTag Tag            `graphql:"primary_tag"`
+	Scene      struct {
+		ID graphql.ID `graphql:"id"`
+	} `graphql:"scene"`
+}
+
+type HierarchicalMultiCriterionInput struct {
+	Value    []graphql.ID   `graphql:"value" json:"value"`
+	Modifier graphql.String `graphql:"modifier" json:"modifier"`
+}
+
+type SceneMarkerFilterType struct {
+	Tags *HierarchicalMultiCriterionInput `graphql:"tags" json:"tags"`
+}
+
+// findTagMarkers returns all scene markers with the tag.
+func findTagMarkers(client *graphql.Client, tagID graphql.ID) ([]SceneMarker, error) {
+	var m struct {
+		FindSceneMarkers struct {
+			SceneMarkers []SceneMarker `graphql:"scene_markers"`
+		} `graphql:"findSceneMarkers(filter: $f, scene_marker_filter: $mf)"`
+	}
+
+	vars := map[string]interface{}{
+		"f": &FindFilterType{
+			PerPage: graphql.NewInt(-1),
+		},
+		"mf": &SceneMarkerFilterType{
+			Tags: &HierarchicalMultiCriterionInput{
+				Value:    []graphql.ID{tagID},
+				Modifier: "INCLUDES",
+			},
+		},
+	}
+
+	err := client.Query(context.Background(), &m, vars)
+	if err != nil {
+		return nil, err
+	}
+
+	return m.FindSceneMarkers.SceneMarkers, nil
+}
+
+type SceneMarkerCreateInput struct {
+	Title        graphql.String `json:"title"`
+	Seconds      graphql.Float  `json:"seconds"`
+	SceneID      graphql.ID     `json:"scene_id"`
+	PrimaryTagID graphql.ID     `json:"primary_tag_id"`
+}
+
+func createSceneMarker(client *graphql.Client, input SceneMarkerCreateInput) error {
+	var m struct {
+		SceneMarkerCreate *struct {
+			ID graphql.ID `graphql:"id"`
+		} `graphql:"sceneMarkerCreate(input: $input)"`
+	}
+
+	vars := map[string]interface{}{
+		"input": input,
+	}
+
+	return client.Mutate(context.Background(), &m, vars)
+}
+
+type SceneMarkerUpdateInput struct {
+	ID           graphql.ID     `json:"id"`
+	Title        graphql.String `json:"title"`
+	Seconds      graphql.Float  `json:"seconds"`
+	SceneID      graphql.ID     `json:"scene_id"`
+	PrimaryTagID graphql.ID     `json:"primary_tag_id"`
+}
+
+func updateSceneMarker(client *graphql.Client, input SceneMarkerUpdateInput) error {
+	var m struct {
+		SceneMarkerUpdate *struct {
+			ID graphql.ID `graphql:"id"`
+		} `graphql:"sceneMarkerUpdate(input: $input)"`
+	}
+
+	vars := map[string]interface{}{
+		"input": input,
+	}
+
+	return client.Mutate(context.Background(), &m, vars)
+}
+
+func destroySceneMarker(client *graphql.Client, id graphql.ID) error {
+	var m struct {
+		SceneMarkerDestroy graphql.Boolean `graphql:"sceneMarkerDestroy(id: $id)"`
+	}
+
+	vars := map[string]interface{}{
+		"id": id,
+	}
+
+	return client.Mutate(context.Background(), &m, vars)
+}
+
 func getDuplicateTagId(client *graphql.Client, tagName string) (*graphql.ID, error) {
 	var m struct {
 		AllTags []Tag `graphql:"allTags"`
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/png"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"stash-plugin-duplicate-finder/internal/plugin/common/log"
+
+	"github.com/rivo/duplo"
+	"github.com/shurcooL/graphql"
+)
+
+// thumbnailSize is the maximum dimension of the image thumbnails generated
+// by stash.
+const thumbnailSize = 640
+
+// getThumbnailFilename returns the filename of the thumbnail generated by
+// stash for the image checksum.
+func getThumbnailFilename(generatedPath, checksum string) string {
+	return filepath.Join(generatedPath, "thumbnails", checksum[:2], fmt.Sprintf("%s_%d.jpg", checksum, thumbnailSize))
+}
+
+// readImage reads the image from its generated thumbnail if it exists,
+// otherwise from the image file.
+func readImage(generatedPath string, img Image) (image.Image, error) {
+	fn := string(img.Path)
+	if img.Checksum != nil && len(*img.Checksum) > 2 && generatedPath != "" {
+		thumbnail := getThumbnailFilename(generatedPath, string(*img.Checksum))
+		if _, err := os.Stat(thumbnail); err == nil {
+			fn = thumbnail
+		}
+	}
+
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	ret, _, err := image.Decode(f)
+	return ret, err
+}
+
+// galleryOverlap is a pair of galleries that share most of their images.
+type galleryOverlap struct {
+	gallery Gallery
+	other   Gallery
+
+	// shared is the number of images of the smaller gallery that are in, or
+	// duplicated in, the other gallery
+	shared int
+
+	// percent is shared as a percentage of the images of the smaller gallery
+	percent float64
+}
+
+func (o galleryOverlap) String() string {
+	return fmt.Sprintf("%s - %s (%d shared images, %.f%%)", galleryLabel(o.gallery), galleryLabel(o.other), o.shared, o.percent)
+}
+
+func galleryLabel(g Gallery) string {
+	if g.Title != nil && *g.Title != "" {
+		return fmt.Sprintf("%s %q", g.ID, string(*g.Title))
+	}
+
+	return fmt.Sprint(g.ID)
+}
+
+// findGalleryOverlaps returns the pairs of galleries where at least
+// minOverlap percent of the images of the smaller gallery are in the other
+// gallery, either as the same image or as a duplicate. matches are the
+// duplicate image matches, keyed by image id.
+func findGalleryOverlaps(images []Image, matches matchResults, minOverlap float64) []galleryOverlap {
+	// images are identified by their group of duplicates, if any
+	groups := matches.groups()
+	imageKey := func(id string) string {
+		if g := groups[id]; g != 0 {
+			return fmt.Sprintf("group %d", g)
+		}
+		return id
+	}
+
+	galleries := make(map[string]Gallery)
+	keys := make(map[string]map[string]bool)
+	for _, img := range images {
+		for _, g := range img.Galleries {
+			id := fmt.Sprint(g.ID)
+			galleries[id] = g
+			if keys[id] == nil {
+				keys[id] = make(map[string]bool)
+			}
+			keys[id][imageKey(fmt.Sprint(img.ID))] = true
+		}
+	}
+
+	// count the shared images of each pair of galleries with any
+	byKey := make(map[string][]string)
+	for id, k := range keys {
+		for key := range k {
+			byKey[key] = append(byKey[key], id)
+		}
+	}
+
+	shared := make(map[[2]string]int)
+	for _, ids := range byKey {
+		sort.Strings(ids)
+		for i := range ids {
+			for j := i + 1; j < len(ids); j++ {
+				shared[[2]string{ids[i], ids[j]}]++
+			}
+		}
+	}
+
+	var ret []galleryOverlap
+	for pair, n := range shared {
+		smaller := minInt(len(keys[pair[0]]), len(keys[pair[1]]))
+		percent := float64(n) / float64(smaller) * 100
+		if percent < minOverlap {
+			continue
+		}
+
+		ret = append(ret, galleryOverlap{
+			gallery: galleries[pair[0]],
+			other:   galleries[pair[1]],
+			shared:  n,
+			percent: percent,
+		})
+	}
+
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].percent != ret[j].percent {
+			return ret[i].percent > ret[j].percent
+		}
+		return ret[i].shared > ret[j].shared
+	})
+
+	return ret
+}
+
+// getImages returns all images on the server.
+func (a *api) getImages() ([]Image, error) {
+	var ret []Image
+	for page := 1; ; page++ {
+		result, err := findImages(a.client, page, prefetchPageSize)
+		if err != nil {
+			return nil, err
+		}
+
+		ret = append(ret, result.Images...)
+		if len(result.Images) < prefetchPageSize || len(ret) >= int(result.Count) {
+			break
+		}
+	}
+
+	return ret, nil
+}
+
+// findImageDuplicates hashes the images on the server into the image
+// database, and logs and handles the duplicate images and the galleries
+// that overlap. Images are read from their thumbnails in generatedPath if
+// they exist, otherwise from the image files. It returns the matches of the
+// images processed and the overlapping galleries.
+func (a *api) findImageDuplicates(generatedPath string) (matchResults, []galleryOverlap, error) {
+	images, err := a.getImages()
+	if err != nil {
+		return nil, nil, fmt.Errorf("error getting images: %s", err.Error())
+	}
+
+	log.Infof("Processing %d images for perceptual hashes...", len(images))
+
+	store := duplo.New()
+	if err := readDB(store, a.cfg.ImagesDBFilename); err != nil {
+		return nil, nil, fmt.Errorf("error reading image database: %s", err.Error())
+	}
+
+	matches, err := readMatches(a.cfg.ImageMatchesFilename)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error reading image matches file: %s", err.Error())
+	}
+
+	var found matchResults
+	exists := make(map[string]bool)
+	for i, img := range images {
+		id := fmt.Sprint(img.ID)
+		exists[id] = true
+
+		if a.isStopping() {
+			continue
+		}
+		log.Progress(float64(i) / float64(len(images)))
+
+		if store.Has(id) && a.cfg.NewOnly {
+			continue
+		}
+
+		decoded, err := readImage(generatedPath, img)
+		if err != nil {
+			log.Errorf("Error processing image %s: %s", id, err.Error())
+			continue
+		}
+
+		hash, _ := duplo.CreateHash(decoded)
+		imageMatches := getHashMatches(store, id, hash, a.cfg.matchCriteria)
+		for _, m := range imageMatches {
+			log.Infof("Duplicate image: %s - %s (score: %.f)", id, m.ID, -m.Score)
+			found = append(found, newMatchResult(id, m, false))
+		}
+
+		matches = matches.set(id, imageMatches, nil)
+		if !store.Has(id) {
+			store.Add(id, hash)
+		}
+	}
+
+	// remove images that no longer exist
+	for _, id := range store.IDs() {
+		if !exists[id.(string)] {
+			store.Delete(id)
+		}
+	}
+	matches = matches.filter(func(r *matchResult) bool {
+		return store.Has(r.Subject) && store.Has(r.Other)
+	})
+
+	if err := storeDB(store, a.cfg.ImagesDBFilename); err != nil {
+		log.Errorf("Error writing image database: %s", err.Error())
+	}
+	if err := storeMatches(matches, a.cfg.ImageMatchesFilename); err != nil {
+		log.Errorf("Error writing image matches file: %s", err.Error())
+	}
+
+	overlaps := findGalleryOverlaps(images, matches, a.cfg.MinGalleryOverlap)
+	for _, o := range overlaps {
+		log.Infof("Overlapping galleries: %s", o)
+	}
+
+	log.Infof("Found %d duplicate images and %d overlapping galleries", len(matches.groups()), len(overlaps))
+
+	if a.duplicateTagID != nil && !a.isStopping() {
+		a.tagImageDuplicates(matches, overlaps)
+	}
+
+	a.logFailures()
+	return found, overlaps, nil
+}
+
+// tagImageDuplicates adds the duplicate tag to the images in the matches and
+// the overlapping galleries.
+func (a *api) tagImageDuplicates(matches matchResults, overlaps []galleryOverlap) {
+	var imageIDs []graphql.ID
+	for id := range matches.groups() {
+		imageIDs = append(imageIDs, graphql.ID(id))
+	}
+
+	if len(imageIDs) > 0 {
+		if err := addImageTag(a.client, imageIDs, *a.duplicateTagID); err != nil {
+			a.addFailure("Error tagging duplicate images: %s", err.Error())
+		}
+	}
+
+	var galleryIDs []graphql.ID
+	added := make(map[graphql.ID]bool)
+	for _, o := range overlaps {
+		for _, id := range []graphql.ID{o.gallery.ID, o.other.ID} {
+			if !added[id] {
+				added[id] = true
+				galleryIDs = append(galleryIDs, id)
+			}
+		}
+	}
+
+	if len(galleryIDs) > 0 {
+		if err := addGalleryTag(a.client, galleryIDs, *a.duplicateTagID); err != nil {
+			a.addFailure("Error tagging overlapping galleries: %s", err.Error())
+		}
+	}
+}
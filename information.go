@@ -0,0 +1,114 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+)
+
+// minTileDetail is the minimum standard deviation of the luminance of a tile
+// for it to be informative.
+const minTileDetail = 0.03 * 65535
+
+// minTileEntropy is the minimum entropy, in bits, of the luminance histogram
+// of a tile for it to be informative. Black, white and solid colour frames
+// have an entropy close to zero, as do most frames of fades.
+const minTileEntropy = 2.0
+
+// entropyBins is the number of bins of the luminance histogram.
+const entropyBins = 32
+
+// defaultFill is the colour of excluded tiles after preparing a sprite with no
+// informative tiles.
+var defaultFill = color.RGBA{128, 128, 128, 255}
+
+// isInformative returns true if the tile has enough detail to be used for
+// matching.
+func isInformative(tile image.Image) bool {
+	b := tile.Bounds()
+	var values []float64
+	histogram := make([]int, entropyBins)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			l := luminance(tile, x, y)
+			values = append(values, l)
+			histogram[minInt(int(l*entropyBins/65536), entropyBins-1)]++
+		}
+	}
+
+	if len(values) == 0 {
+		return false
+	}
+
+	_, stdDev := meanStdDev(values)
+	if stdDev < minTileDetail {
+		return false
+	}
+
+	entropy := 0.0
+	for _, count := range histogram {
+		if count > 0 {
+			p := float64(count) / float64(len(values))
+			entropy -= p * math.Log2(p)
+		}
+	}
+
+	return entropy >= minTileEntropy
+}
+
+// uninformativeTiles returns the indexes of the tiles that are not
+// informative.
+func uninformativeTiles(tiles []image.Image) []int {
+	var ret []int
+	for i, t := range tiles {
+		if !isInformative(t) {
+			ret = append(ret, i)
+		}
+	}
+
+	return ret
+}
+
+// fillTiles returns a copy of the sprite with the tiles at the provided
+// indexes filled with the colour.
+func fillTiles(img image.Image, cols, rows int, indexes []int, c color.Color) image.Image {
+	bounds := img.Bounds()
+	ret := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(ret, ret.Bounds(), img, bounds.Min, draw.Src)
+
+	w := bounds.Dx() / cols
+	h := bounds.Dy() / rows
+	fill := image.NewUniform(c)
+	for _, i := range indexes {
+		x := (i % cols) * w
+		y := (i / cols) * h
+		draw.Draw(ret, image.Rect(x, y, x+w, y+h), fill, image.Point{}, draw.Src)
+	}
+
+	return ret
+}
+
+// meanColour returns the mean colour of the tiles, or the default fill colour
+// if there are no tiles.
+func meanColour(tiles []image.Image) color.Color {
+	var r, g, b, n uint64
+	for _, t := range tiles {
+		bounds := t.Bounds()
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			for x := bounds.Min.X; x < bounds.Max.X; x++ {
+				cr, cg, cb, _ := t.At(x, y).RGBA()
+				r += uint64(cr >> 8)
+				g += uint64(cg >> 8)
+				b += uint64(cb >> 8)
+				n++
+			}
+		}
+	}
+
+	if n == 0 {
+		return defaultFill
+	}
+
+	return color.RGBA{uint8(r / n), uint8(g / n), uint8(b / n), 255}
+}
@@ -71,7 +71,21 @@ var validLevels = []Level{
 const startLevelChar byte = 1
 const endLevelChar byte = 2
 
+var plain bool
+
+// SetPlain sets whether log messages are output as plain text, prefixed with
+// the level name, rather than encoded for the stash server. This is intended
+// for plugin executables that are run outside of stash. Progress messages are
+// not output in plain mode.
+func SetPlain(value bool) {
+	plain = value
+}
+
 func (l Level) prefix() string {
+	if plain {
+		return strings.ToUpper(l.Name) + ":"
+	}
+
 	return string([]byte{
 		startLevelChar,
 		byte(l.char),
@@ -80,7 +94,7 @@ func (l Level) prefix() string {
 }
 
 func (l Level) log(args ...interface{}) {
-	if l.char == 0 {
+	if l.char == 0 || (plain && l.Name == "") {
 		return
 	}
 
@@ -92,11 +106,14 @@ func (l Level) log(args ...interface{}) {
 }
 
 func (l Level) logf(format string, args ...interface{}) {
-	if l.char == 0 {
+	if l.char == 0 || (plain && l.Name == "") {
 		return
 	}
 
 	formatToUse := string(l.prefix()) + format + "\n"
+	if plain {
+		formatToUse = l.prefix() + " " + format + "\n"
+	}
 	fmt.Fprintf(os.Stderr, formatToUse, args...)
 }
 
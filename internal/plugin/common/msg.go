@@ -1,6 +1,9 @@
 package common
 
-import "net/http"
+import (
+	"encoding/json"
+	"net/http"
+)
 
 // StashServerConnection represents the connection details needed for a
 // plugin instance to connect to its parent stash server.
@@ -73,6 +76,49 @@ func (m ArgsMap) Float(key string) float64 {
 	return ret
 }
 
+// HookContextKey is the argument key of the HookContext provided to plugin
+// operations triggered by a hook.
+const HookContextKey = "hookContext"
+
+// HookContext is passed as a PluginArgValue and indicates which hook
+// triggered the plugin operation.
+type HookContext struct {
+	// ID of the object that triggered the hook, if applicable
+	ID int `json:"id,omitempty"`
+
+	// Type of the hook, such as Scene.Create.Post
+	Type string `json:"type"`
+
+	// Input of the operation that triggered the hook
+	Input interface{} `json:"input"`
+
+	// InputFields are the fields provided in the input of update operations
+	InputFields []string `json:"inputFields,omitempty"`
+}
+
+// ToHookContext returns the HookContext argument or nil if the operation was
+// not triggered by a hook.
+func (m ArgsMap) ToHookContext() *HookContext {
+	v, found := m[HookContextKey]
+	if !found || v == nil {
+		return nil
+	}
+
+	// the value is decoded as a generic map, so it is converted by
+	// re-encoding it
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil
+	}
+
+	var ret HookContext
+	if err := json.Unmarshal(data, &ret); err != nil {
+		return nil
+	}
+
+	return &ret
+}
+
 // PluginInput is the data structure that is sent to plugin instances when they
 // are spawned.
 type PluginInput struct {
@@ -3,34 +3,150 @@
 package util
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/http/cookiejar"
 	"net/url"
+	"strings"
+	"time"
 
 	"github.com/shurcooL/graphql"
 
 	"stash-plugin-duplicate-finder/internal/plugin/common"
 )
 
+// ClientOptions contains optional settings for the connection to the stash
+// server.
+type ClientOptions struct {
+	// APIKey is sent in the ApiKey header of each request, if set.
+	APIKey string
+
+	// CACertFile is the path to a PEM encoded CA bundle used to verify the
+	// server certificate, in addition to the system certificates.
+	CACertFile string
+
+	// InsecureSkipVerify disables verification of the server certificate.
+	InsecureSkipVerify bool
+
+	// Timeout is the time limit for each call to the server, including any
+	// retries. Zero means no limit.
+	Timeout time.Duration
+
+	// MaxRetries is the number of times a request is retried after a
+	// transport error or a 5xx response.
+	MaxRetries int
+
+	// RetryBackoff is the delay before the first retry. The delay doubles
+	// with each subsequent retry.
+	RetryBackoff time.Duration
+
+	// RequestsPerSecond limits the rate of requests sent to the server. Zero
+	// means no limit.
+	RequestsPerSecond float64
+}
+
 // NewClient creates a graphql Client connecting to the stash server using
 // the provided server connection details.
-func NewClient(provider common.StashServerConnection, addr string) *graphql.Client {
+func NewClient(provider common.StashServerConnection, addr string, options ClientOptions) (*graphql.Client, error) {
 	u, _ := url.Parse(fmt.Sprintf("http://%s:%d/graphql", addr, provider.Port))
 	u.Scheme = provider.Scheme
 
-	cookieJar, _ := cookiejar.New(nil)
+	httpClient, err := newHTTPClient(options)
+	if err != nil {
+		return nil, err
+	}
 
 	cookie := provider.SessionCookie
 	if cookie != nil {
-		cookieJar.SetCookies(u, []*http.Cookie{
+		httpClient.Jar.SetCookies(u, []*http.Cookie{
 			cookie,
 		})
 	}
 
-	httpClient := &http.Client{
-		Jar: cookieJar,
+	return graphql.NewClient(u.String(), httpClient), nil
+}
+
+// NewClientFromURL creates a graphql Client connecting to the stash server at
+// the provided base URL, such as http://localhost:9999.
+func NewClientFromURL(serverURL string, options ClientOptions) (*graphql.Client, error) {
+	u, err := url.Parse(serverURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid server URL %s: %s", serverURL, err.Error())
+	}
+
+	if u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("invalid server URL %s: scheme and host are required", serverURL)
+	}
+
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/graphql"
+
+	httpClient, err := newHTTPClient(options)
+	if err != nil {
+		return nil, err
+	}
+
+	return graphql.NewClient(u.String(), httpClient), nil
+}
+
+func newHTTPClient(options ClientOptions) (*http.Client, error) {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: options.InsecureSkipVerify,
+	}
+
+	if options.CACertFile != "" {
+		pem, err := ioutil.ReadFile(options.CACertFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading CA certificate file: %s", err.Error())
+		}
+
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA certificate file %s", options.CACertFile)
+		}
+
+		tlsConfig.RootCAs = pool
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+
+	cookieJar, _ := cookiejar.New(nil)
+
+	return &http.Client{
+		Jar:     cookieJar,
+		Timeout: options.Timeout,
+		Transport: &apiKeyTransport{
+			apiKey: options.APIKey,
+			base: &retryTransport{
+				base:       transport,
+				maxRetries: options.MaxRetries,
+				backoff:    options.RetryBackoff,
+				limiter:    newRateLimiter(options.RequestsPerSecond),
+			},
+		},
+	}, nil
+}
+
+// apiKeyTransport adds the ApiKey header to each request.
+type apiKeyTransport struct {
+	apiKey string
+	base   http.RoundTripper
+}
+
+func (t *apiKeyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.apiKey == "" {
+		return t.base.RoundTrip(req)
 	}
 
-	return graphql.NewClient(u.String(), httpClient)
+	// RoundTrippers must not modify the original request
+	r := req.Clone(req.Context())
+	r.Header.Set("ApiKey", t.apiKey)
+	return t.base.RoundTrip(r)
 }
@@ -0,0 +1,148 @@
+package util
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// retryTransport retries requests that fail with a transport error or a 5xx
+// status code, waiting an exponentially increasing time between attempts. It
+// also limits the rate at which requests are sent. GraphQL mutations are only
+// retried if they were never sent, as the server may have applied a mutation
+// that failed.
+type retryTransport struct {
+	base       http.RoundTripper
+	maxRetries int
+	backoff    time.Duration
+	limiter    *rateLimiter
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	mutation := isMutation(req)
+	backoff := t.backoff
+	for attempt := 0; ; attempt++ {
+		if err := t.limiter.wait(req); err != nil {
+			return nil, err
+		}
+
+		resp, err := t.base.RoundTrip(req)
+		if !shouldRetry(resp, err, mutation) || attempt >= t.maxRetries || (req.Body != nil && req.GetBody == nil) {
+			return resp, err
+		}
+
+		if resp != nil {
+			// discard the body so that the connection can be reused
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+		}
+
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+
+		// rewind the request body for the next attempt
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req = req.Clone(req.Context())
+			req.Body = body
+		}
+	}
+}
+
+func shouldRetry(resp *http.Response, err error, mutation bool) bool {
+	if mutation {
+		return err != nil && !wasSent(err)
+	}
+
+	if err != nil {
+		return true
+	}
+
+	return resp.StatusCode >= 500
+}
+
+// wasSent returns false if the request failed before it could be sent,
+// because the connection to the server could not be made.
+func wasSent(err error) bool {
+	var opErr *net.OpError
+	return !errors.As(err, &opErr) || opErr.Op != "dial"
+}
+
+// isMutation returns true if the request is a GraphQL mutation.
+func isMutation(req *http.Request) bool {
+	if req.GetBody == nil {
+		return false
+	}
+
+	body, err := req.GetBody()
+	if err != nil {
+		return false
+	}
+	defer body.Close()
+
+	var payload struct {
+		Query string `json:"query"`
+	}
+	if err := json.NewDecoder(body).Decode(&payload); err != nil {
+		return false
+	}
+
+	return strings.HasPrefix(strings.TrimSpace(payload.Query), "mutation")
+}
+
+// rateLimiter spaces requests so that no more than a fixed number of requests
+// are sent per second. A nil rateLimiter does not limit requests.
+type rateLimiter struct {
+	mutex    sync.Mutex
+	interval time.Duration
+	next     time.Time
+}
+
+func newRateLimiter(requestsPerSecond float64) *rateLimiter {
+	if requestsPerSecond <= 0 {
+		return nil
+	}
+
+	return &rateLimiter{
+		interval: time.Duration(float64(time.Second) / requestsPerSecond),
+	}
+}
+
+func (l *rateLimiter) wait(req *http.Request) error {
+	if l == nil {
+		return nil
+	}
+
+	l.mutex.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	delay := l.next.Sub(now)
+	l.next = l.next.Add(l.interval)
+	l.mutex.Unlock()
+
+	if delay <= 0 {
+		return nil
+	}
+
+	select {
+	case <-req.Context().Done():
+		return req.Context().Err()
+	case <-time.After(delay):
+		return nil
+	}
+}
@@ -0,0 +1,214 @@
+package util
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+type roundTripFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func newTestRequest(t *testing.T, query string) *http.Request {
+	body := `{"query":"` + query + `"}`
+	req, err := http.NewRequest(http.MethodPost, "http://stash.invalid/graphql", bytes.NewBufferString(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return req
+}
+
+func statusResponse(code int) *http.Response {
+	return &http.Response{
+		StatusCode: code,
+		Body:       ioutil.NopCloser(strings.NewReader("")),
+	}
+}
+
+var (
+	errDial  = &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+	errReset = &net.OpError{Op: "read", Net: "tcp", Err: errors.New("connection reset by peer")}
+)
+
+func TestRetryTransport(t *testing.T) {
+	tests := []struct {
+		name     string
+		query    string
+		status   int
+		err      error
+		attempts int
+	}{
+		{"query success", "{allTags{id}}", http.StatusOK, nil, 1},
+		{"query server error", "{allTags{id}}", http.StatusInternalServerError, nil, 4},
+		{"query client error", "{allTags{id}}", http.StatusBadRequest, nil, 1},
+		{"query dial error", "{allTags{id}}", 0, errDial, 4},
+		{"query read error", "{allTags{id}}", 0, errReset, 4},
+		{"mutation success", "mutation{sceneMarkerDestroy(id: 1)}", http.StatusOK, nil, 1},
+		{"mutation server error", "mutation{sceneMarkerDestroy(id: 1)}", http.StatusBadGateway, nil, 1},
+		{"mutation dial error", "mutation{sceneMarkerDestroy(id: 1)}", 0, errDial, 4},
+		{"mutation read error", "  mutation($id:ID!){sceneMarkerDestroy(id: $id)}", 0, errReset, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := newTestRequest(t, tt.query)
+			want, _ := ioutil.ReadAll(mustGetBody(t, req))
+
+			attempts := 0
+			transport := &retryTransport{
+				base: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+					attempts++
+
+					// the body must be replayed for each attempt
+					got, _ := ioutil.ReadAll(r.Body)
+					if !bytes.Equal(got, want) {
+						t.Errorf("attempt %d body = %q, want %q", attempts, got, want)
+					}
+
+					if tt.err != nil {
+						return nil, tt.err
+					}
+					return statusResponse(tt.status), nil
+				}),
+				maxRetries: 3,
+				backoff:    time.Millisecond,
+			}
+
+			resp, err := transport.RoundTrip(req)
+			if attempts != tt.attempts {
+				t.Errorf("attempts = %d, want %d", attempts, tt.attempts)
+			}
+
+			if tt.err != nil {
+				if err != tt.err {
+					t.Errorf("err = %v, want %v", err, tt.err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if resp.StatusCode != tt.status {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.status)
+			}
+		})
+	}
+}
+
+func mustGetBody(t *testing.T, req *http.Request) io.ReadCloser {
+	body, err := req.GetBody()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return body
+}
+
+func TestRetryTransportBackoff(t *testing.T) {
+	var times []time.Time
+	transport := &retryTransport{
+		base: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+			times = append(times, time.Now())
+			return statusResponse(http.StatusServiceUnavailable), nil
+		}),
+		maxRetries: 3,
+		backoff:    10 * time.Millisecond,
+	}
+
+	if _, err := transport.RoundTrip(newTestRequest(t, "{allTags{id}}")); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(times) != 4 {
+		t.Fatalf("attempts = %d, want 4", len(times))
+	}
+
+	// the delay doubles after each attempt
+	for i, want := range []time.Duration{10, 20, 40} {
+		want *= time.Millisecond
+		if got := times[i+1].Sub(times[i]); got < want {
+			t.Errorf("delay before attempt %d = %v, want at least %v", i+2, got, want)
+		}
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	tests := []struct {
+		name              string
+		requestsPerSecond float64
+		requests          int
+		minElapsed        time.Duration
+	}{
+		{"unlimited", 0, 5, 0},
+		{"negative", -1, 5, 0},
+		{"limited", 100, 5, 40 * time.Millisecond},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newRateLimiter(tt.requestsPerSecond)
+			if tt.requestsPerSecond <= 0 && l != nil {
+				t.Fatal("expected no limiter")
+			}
+
+			req := newTestRequest(t, "{allTags{id}}")
+			start := time.Now()
+			for i := 0; i < tt.requests; i++ {
+				if err := l.wait(req); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if elapsed := time.Since(start); elapsed < tt.minElapsed {
+				t.Errorf("elapsed = %v, want at least %v", elapsed, tt.minElapsed)
+			}
+		})
+	}
+}
+
+func TestWasSent(t *testing.T) {
+	// a connection to a closed port fails before the request is sent
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	req := newTestRequest(t, "mutation{sceneMarkerDestroy(id: 1)}")
+	req.URL.Host = addr
+	_, err = (&http.Transport{}).RoundTrip(req)
+	if err == nil {
+		t.Fatal("expected a connection error")
+	}
+
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"refused", err, false},
+		{"dial", errDial, false},
+		{"read", errReset, true},
+		{"other", errors.New("unexpected EOF"), true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := wasSent(tt.err); got != tt.want {
+				t.Errorf("wasSent(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+
+	"stash-plugin-duplicate-finder/internal/plugin/common/log"
+
+	"github.com/rivo/duplo"
+)
+
+// introHashDistance is the maximum hamming distance between the hashes of
+// two tiles for them to be the same frame of an intro or outro.
+const introHashDistance = 8
+
+const (
+	introPositionStart = "start"
+	introPositionEnd   = "end"
+)
+
+// hexHash is a tile hash, encoded as a hexadecimal string.
+type hexHash uint64
+
+func (h hexHash) MarshalText() ([]byte, error) {
+	return []byte(fmt.Sprintf("%016x", uint64(h))), nil
+}
+
+func (h *hexHash) UnmarshalText(text []byte) error {
+	v, err := strconv.ParseUint(string(text), 16, 64)
+	if err != nil {
+		return fmt.Errorf("invalid tile hash %q", string(text))
+	}
+
+	*h = hexHash(v)
+	return nil
+}
+
+// knownIntro is a sequence of tiles found at the start or end of many
+// sprites, such as a studio intro or outro.
+type knownIntro struct {
+	Position string `json:"position"`
+
+	// Hashes are the hashes of the tiles, in the order they appear in the
+	// sprite
+	Hashes []hexHash `json:"hashes"`
+
+	// Scenes is the number of sprites the sequence was found in
+	Scenes int `json:"scenes"`
+}
+
+// tiles returns the indexes of the tiles of the sprite that match the intro,
+// or nil if the sprite does not contain the intro. hashes are the tile hashes
+// of the sprite.
+func (i knownIntro) tiles(hashes []uint64) []int {
+	if len(i.Hashes) > len(hashes) {
+		return nil
+	}
+
+	start := 0
+	if i.Position == introPositionEnd {
+		start = len(hashes) - len(i.Hashes)
+	}
+
+	var ret []int
+	for j, h := range i.Hashes {
+		if hammingDistance(uint64(h), hashes[start+j]) > introHashDistance {
+			return nil
+		}
+		ret = append(ret, start+j)
+	}
+
+	return ret
+}
+
+// introTiles returns the indexes of the tiles that match any of the intros.
+func introTiles(tiles []image.Image, intros []knownIntro) []int {
+	if len(intros) == 0 {
+		return nil
+	}
+
+	hashes := make([]uint64, len(tiles))
+	for i, t := range tiles {
+		hashes[i] = tileHash(t)
+	}
+
+	found := make(map[int]bool)
+	for _, intro := range intros {
+		for _, i := range intro.tiles(hashes) {
+			found[i] = true
+		}
+	}
+
+	var ret []int
+	for i := range found {
+		ret = append(ret, i)
+	}
+	sort.Ints(ret)
+
+	return ret
+}
+
+func storeIntros(intros []knownIntro, filename string) error {
+	if intros == nil {
+		intros = []knownIntro{}
+	}
+
+	data, err := json.MarshalIndent(intros, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(filename, data)
+}
+
+// readIntros reads the known intros file. It returns no intros if the file
+// does not exist.
+func readIntros(filename string) ([]knownIntro, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	var ret []knownIntro
+	if err := json.Unmarshal(data, &ret); err != nil {
+		return nil, err
+	}
+
+	return ret, nil
+}
+
+// edgeTiles contains the hashes of the tiles at the start or end of a
+// sprite, ordered from the edge of the sprite inwards.
+type edgeTiles struct {
+	hashes      []uint64
+	informative []bool
+}
+
+// newEdgeTiles returns the edge tiles of the position, up to n tiles.
+func newEdgeTiles(tiles []image.Image, position string, n int) edgeTiles {
+	var ret edgeTiles
+	for i := 0; i < n && i < len(tiles); i++ {
+		t := tiles[i]
+		if position == introPositionEnd {
+			t = tiles[len(tiles)-1-i]
+		}
+
+		ret.hashes = append(ret.hashes, tileHash(t))
+		ret.informative = append(ret.informative, isInformative(t))
+	}
+
+	return ret
+}
+
+// findIntros returns the sequences of edge tiles shared by at least minScenes
+// of the sprites. Sprites are grouped by the hash of each tile in turn,
+// starting from the edge, and the longest sequence of each group is
+// returned. Sequences of uninformative tiles, such as black frames, are not
+// intros.
+func findIntros(position string, edges []edgeTiles, minScenes int) []knownIntro {
+	members := make([]int, len(edges))
+	for i := range members {
+		members[i] = i
+	}
+
+	var ret []knownIntro
+	var find func(members []int, depth int, informative bool) bool
+	find = func(members []int, depth int, informative bool) bool {
+		var groups [][]int
+		for _, m := range members {
+			if depth >= len(edges[m].hashes) {
+				continue
+			}
+
+			found := false
+			for i, g := range groups {
+				if hammingDistance(edges[g[0]].hashes[depth], edges[m].hashes[depth]) <= introHashDistance {
+					groups[i] = append(g, m)
+					found = true
+					break
+				}
+			}
+
+			if !found {
+				groups = append(groups, []int{m})
+			}
+		}
+
+		added := false
+		for _, g := range groups {
+			if len(g) < minScenes {
+				continue
+			}
+
+			rep := edges[g[0]]
+			groupInformative := informative || rep.informative[depth]
+			if find(g, depth+1, groupInformative) {
+				added = true
+			} else if groupInformative {
+				intro := knownIntro{
+					Position: position,
+					Scenes:   len(g),
+				}
+				for i := 0; i <= depth; i++ {
+					intro.Hashes = append(intro.Hashes, hexHash(rep.hashes[i]))
+				}
+				if position == introPositionEnd {
+					for i, j := 0, len(intro.Hashes)-1; i < j; i, j = i+1, j-1 {
+						intro.Hashes[i], intro.Hashes[j] = intro.Hashes[j], intro.Hashes[i]
+					}
+				}
+
+				ret = append(ret, intro)
+				added = true
+			}
+		}
+
+		return added
+	}
+
+	find(members, 0, false)
+	return ret
+}
+
+// detectIntros finds the intros and outros shared by the sprites in path and
+// writes them to the intros file. If intros are excluded, the hashes of the
+// sprites with changed intro tiles are removed from the database, so that
+// they are hashed again by the next scan.
+func (a *api) detectIntros(path string) ([]knownIntro, error) {
+	files, err := ioutil.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	var starts, ends []edgeTiles
+	for i, f := range files {
+		if a.isStopping() {
+			return nil, errors.New("intro detection stopped")
+		}
+
+		fn := filepath.Join(path, f.Name())
+		if !isSpriteFile(fn) {
+			continue
+		}
+		log.Progress(float64(i) / float64(len(files)))
+
+		tiles, err := a.introSpriteTiles(fn)
+		if err != nil {
+			log.Errorf("Error processing file %s: %s", f.Name(), err.Error())
+			continue
+		}
+
+		names = append(names, getChecksum(fn))
+		starts = append(starts, newEdgeTiles(tiles, introPositionStart, a.cfg.MaxIntroTiles))
+		ends = append(ends, newEdgeTiles(tiles, introPositionEnd, a.cfg.MaxIntroTiles))
+	}
+
+	intros := append(findIntros(introPositionStart, starts, a.cfg.MinIntroScenes), findIntros(introPositionEnd, ends, a.cfg.MinIntroScenes)...)
+	if err := storeIntros(intros, a.cfg.IntrosFilename); err != nil {
+		return nil, fmt.Errorf("error writing intros file: %s", err.Error())
+	}
+
+	if a.cfg.ExcludeIntros {
+		if err := a.invalidateIntroSprites(names, starts, ends, intros); err != nil {
+			return nil, err
+		}
+	}
+
+	return intros, nil
+}
+
+// introSpriteTiles returns the tiles of the sprite file, with any borders
+// removed as when hashing.
+func (a *api) introSpriteTiles(fn string) ([]image.Image, error) {
+	img, err := readSprite(fn)
+	if err != nil {
+		return nil, err
+	}
+
+	tiles := spriteTiles(img, spriteGridSize, spriteGridSize)
+	if len(tiles) == 0 || !a.cfg.CropBorders {
+		return tiles, nil
+	}
+
+	img, _ = cropBorders(img, tiles)
+	return spriteTiles(img, spriteGridSize, spriteGridSize), nil
+}
+
+// invalidateIntroSprites removes the hashes of the sprites whose intro tiles
+// differ from those used when they were hashed.
+func (a *api) invalidateIntroSprites(names []string, starts, ends []edgeTiles, intros []knownIntro) error {
+	lock, err := a.lockDB()
+	if err != nil {
+		return err
+	}
+	defer lock.release()
+
+	store := duplo.New()
+	if err := readDB(store, a.cfg.DBFilename); err != nil {
+		return fmt.Errorf("error reading database: %s", err.Error())
+	}
+
+	meta, err := readMeta(a.cfg.MetaFilename)
+	if err != nil {
+		return fmt.Errorf("error reading meta file: %s", err.Error())
+	}
+
+	tileCount := spriteGridSize * spriteGridSize
+	removed := 0
+	for i, name := range names {
+		if !store.Has(name) {
+			continue
+		}
+
+		// only the edge tiles are needed to match the intros
+		hashes := make([]uint64, tileCount)
+		for j := range starts[i].hashes {
+			hashes[j] = starts[i].hashes[j]
+		}
+		for j := range ends[i].hashes {
+			hashes[tileCount-1-j] = ends[i].hashes[j]
+		}
+
+		found := make(map[int]bool)
+		for _, intro := range intros {
+			for _, t := range intro.tiles(hashes) {
+				found[t] = true
+			}
+		}
+
+		var existing []int
+		if m := meta[name]; m != nil {
+			existing = m.IntroTiles
+		}
+
+		changed := len(existing) != len(found)
+		for _, t := range existing {
+			changed = changed || !found[t]
+		}
+
+		if changed {
+			store.Delete(name)
+			removed++
+		}
+	}
+
+	if removed == 0 {
+		return nil
+	}
+
+	matches, err := readMatches(a.cfg.MatchesFilename)
+	if err != nil {
+		return fmt.Errorf("error reading matches file: %s", err.Error())
+	}
+
+	matches = matches.filter(func(r *matchResult) bool {
+		return store.Has(r.Subject) && store.Has(r.Other)
+	})
+
+	if err := storeDB(store, a.cfg.DBFilename); err != nil {
+		return fmt.Errorf("error writing database: %s", err.Error())
+	}
+	if err := storeMatches(matches, a.cfg.MatchesFilename); err != nil {
+		return fmt.Errorf("error writing matches file: %s", err.Error())
+	}
+
+	log.Infof("Removed %d hashes of sprites with changed intros. These will be hashed again by the next scan", removed)
+	return nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"stash-plugin-duplicate-finder/internal/plugin/common/log"
+)
+
+// lockRefresh is the interval at which a held lock file is touched, so that
+// other runs can tell that it is still in use.
+const lockRefresh = 30 * time.Second
+
+// lockTimeout is the age after which a lock file that has not been touched is
+// treated as stale, such as when the run holding it was killed.
+const lockTimeout = 2 * time.Minute
+
+// lockPoll is the interval at which a lock file held by another run is
+// checked while waiting for it.
+const lockPoll = 500 * time.Millisecond
+
+// errLockStopped is returned when the run is stopped while waiting for a lock.
+var errLockStopped = errors.New("stopped while waiting for another run to finish")
+
+// fileLock is a lock file that prevents runs, such as a scan and a hook, from
+// reading and writing the database files at the same time.
+type fileLock struct {
+	filename string
+	done     chan struct{}
+}
+
+// acquireLock creates the lock file, waiting while it is held by another run.
+// It gives up if stopping returns true while waiting.
+func acquireLock(filename string, stopping func() bool) (*fileLock, error) {
+	waiting := false
+	for {
+		f, err := os.OpenFile(filename, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err == nil {
+			fmt.Fprintf(f, "%d\n", os.Getpid())
+			f.Close()
+
+			l := &fileLock{
+				filename: filename,
+				done:     make(chan struct{}),
+			}
+			go l.refresh()
+			return l, nil
+		}
+
+		if !os.IsExist(err) {
+			return nil, err
+		}
+
+		if info, err := os.Stat(filename); err == nil && time.Since(info.ModTime()) > lockTimeout {
+			log.Warnf("Removing stale lock file %s", filename)
+			os.Remove(filename)
+			continue
+		}
+
+		if stopping() {
+			return nil, errLockStopped
+		}
+
+		if !waiting {
+			log.Infof("Waiting for another run to finish with the database (%s)", filename)
+			waiting = true
+		}
+		time.Sleep(lockPoll)
+	}
+}
+
+// refresh touches the lock file until it is released.
+func (l *fileLock) refresh() {
+	ticker := time.NewTicker(lockRefresh)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-l.done:
+			return
+		case <-ticker.C:
+			now := time.Now()
+			if err := os.Chtimes(l.filename, now, now); err != nil {
+				log.Warnf("Error refreshing lock file: %s", err.Error())
+			}
+		}
+	}
+}
+
+// release removes the lock file.
+func (l *fileLock) release() {
+	close(l.done)
+	if err := os.Remove(l.filename); err != nil {
+		log.Warnf("Error removing lock file: %s", err.Error())
+	}
+}
+
+// writeFileAtomic writes data to a temporary file next to filename and
+// renames it over filename, so that readers never see a partially written
+// file.
+func writeFileAtomic(filename string, data []byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(filename), filepath.Base(filename)+".tmp")
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(f.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), filename)
+	}
+
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	"stash-plugin-duplicate-finder/internal/plugin/common/log"
+
+	"github.com/shurcooL/graphql"
+)
+
+// markerTimeTolerance is the maximum difference in seconds between the times
+// of markers for them to be the same marker.
+const markerTimeTolerance = 0.5
+
+// markerTitlePrefix is the start of the titles of the markers created by the
+// plugin, which is followed by the id of the other scene.
+const markerTitlePrefix = "Duplicate of scene "
+
+// wantedMarker is a marker that should exist on a scene.
+type wantedMarker struct {
+	title   string
+	seconds float64
+}
+
+// markerChanges counts the markers changed by syncMarkers.
+type markerChanges struct {
+	created   int
+	updated   int
+	destroyed int
+}
+
+func (c markerChanges) String() string {
+	return fmt.Sprintf("created %d, updated %d and removed %d duplicate markers", c.created, c.updated, c.destroyed)
+}
+
+// markerScene returns the scene of the sprite, or nil if there is no such
+// scene. Other errors are returned, as the markers of a scene that could not
+// be looked up would otherwise be removed.
+func (a *api) markerScene(name string) (*Scene, error) {
+	s, err := a.cache.get(name)
+	if err == nil {
+		return s, nil
+	}
+
+	if _, ok := err.(sceneNotFoundError); !ok {
+		return nil, fmt.Errorf("error getting scene with checksum %s: %s", name, err.Error())
+	}
+
+	a.addSceneError(name, err)
+	return nil, nil
+}
+
+// wantedMarkers returns the markers that should exist for the matching
+// segments of the results, keyed by scene id. Each segment has a marker at
+// its start in both scenes, titled with the id of the other scene. Pairs
+// marked as not duplicate are excluded.
+func (a *api) wantedMarkers(results matchResults) (map[string][]wantedMarker, error) {
+	ret := make(map[string][]wantedMarker)
+	for _, r := range results {
+		if len(r.Segments) == 0 || a.decisions.isIgnored(r.Subject, r.Other) {
+			continue
+		}
+
+		subject, err := a.markerScene(r.Subject)
+		if err != nil {
+			return nil, err
+		}
+
+		other, err := a.markerScene(r.Other)
+		if err != nil {
+			return nil, err
+		}
+
+		if subject == nil || other == nil {
+			continue
+		}
+
+		subjectID, otherID := fmt.Sprint(subject.ID), fmt.Sprint(other.ID)
+		for _, s := range r.Segments {
+			ret[subjectID] = append(ret[subjectID], wantedMarker{title: markerTitlePrefix + otherID, seconds: s.SubjectStart})
+			ret[otherID] = append(ret[otherID], wantedMarker{title: markerTitlePrefix + subjectID, seconds: s.OtherStart})
+		}
+	}
+
+	return ret, nil
+}
+
+// syncMarkers makes the duplicate markers in stash match the segments of the
+// results. Missing markers are created, markers whose segment has moved are
+// updated, and markers of segments that no longer match are removed. Only
+// markers with the marker tag as their primary tag and a title created by
+// the plugin are changed. If only is not nil, then only the markers of the
+// scenes with those ids are changed. No markers are changed if a scene of the
+// results cannot be looked up.
+func (a *api) syncMarkers(results matchResults, only map[string]bool) (markerChanges, error) {
+	var ret markerChanges
+
+	markers, err := findTagMarkers(a.client, *a.markerTagID)
+	if err != nil {
+		return ret, fmt.Errorf("error getting duplicate markers: %s", err.Error())
+	}
+
+	existing := make(map[string][]SceneMarker)
+	for _, m := range markers {
+		if m.PrimaryTag.ID == *a.markerTagID && strings.HasPrefix(string(m.Title), markerTitlePrefix) {
+			id := fmt.Sprint(m.Scene.ID)
+			existing[id] = append(existing[id], m)
+		}
+	}
+
+	wanted, err := a.wantedMarkers(results)
+	if err != nil {
+		return ret, fmt.Errorf("not syncing markers: %s", err.Error())
+	}
+
+	var sceneIDs []string
+	for id := range wanted {
+		sceneIDs = append(sceneIDs, id)
+	}
+	for id := range existing {
+		if _, found := wanted[id]; !found {
+			sceneIDs = append(sceneIDs, id)
+		}
+	}
+	sort.Strings(sceneIDs)
+
+	for _, id := range sceneIDs {
+		if a.isStopping() {
+			break
+		}
+
+		if only != nil && !only[id] {
+			continue
+		}
+
+		a.syncSceneMarkers(graphql.ID(id), wanted[id], existing[id], &ret)
+	}
+
+	return ret, nil
+}
+
+// syncSceneMarkers changes the existing markers of the scene to match the
+// wanted markers.
+func (a *api) syncSceneMarkers(sceneID graphql.ID, wanted []wantedMarker, existing []SceneMarker, changes *markerChanges) {
+	used := make([]bool, len(existing))
+
+	// markers that already exist are left unchanged
+	var missing []wantedMarker
+	for _, w := range wanted {
+		found := false
+		for i, m := range existing {
+			if !used[i] && string(m.Title) == w.title && math.Abs(float64(m.Seconds)-w.seconds) <= markerTimeTolerance {
+				used[i] = true
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			missing = append(missing, w)
+		}
+	}
+
+	for _, w := range missing {
+		// move an unused marker of the same scene pair if there is one
+		moved := false
+		for i, m := range existing {
+			if used[i] || string(m.Title) != w.title {
+				continue
+			}
+
+			used[i] = true
+			moved = true
+			err := updateSceneMarker(a.client, SceneMarkerUpdateInput{
+				ID:           m.ID,
+				Title:        graphql.String(w.title),
+				Seconds:      graphql.Float(w.seconds),
+				SceneID:      sceneID,
+				PrimaryTagID: *a.markerTagID,
+			})
+			if err != nil {
+				a.addFailure("Error updating marker %s on scene %s: %s", m.ID, sceneID, err.Error())
+			} else {
+				changes.updated++
+			}
+			break
+		}
+
+		if moved {
+			continue
+		}
+
+		err := createSceneMarker(a.client, SceneMarkerCreateInput{
+			Title:        graphql.String(w.title),
+			Seconds:      graphql.Float(w.seconds),
+			SceneID:      sceneID,
+			PrimaryTagID: *a.markerTagID,
+		})
+		if err != nil {
+			a.addFailure("Error creating marker on scene %s: %s", sceneID, err.Error())
+		} else {
+			changes.created++
+		}
+	}
+
+	for i, m := range existing {
+		if used[i] {
+			continue
+		}
+
+		if err := destroySceneMarker(a.client, m.ID); err != nil {
+			a.addFailure("Error removing marker %s from scene %s: %s", m.ID, sceneID, err.Error())
+		} else {
+			changes.destroyed++
+		}
+	}
+}
+
+// syncStoredMarkers syncs the duplicate markers with the matches in the
+// matches file. If checksums is not nil, then only the markers of those
+// scenes and their duplicates are synced.
+func (a *api) syncStoredMarkers(checksums []string) error {
+	matches, err := readMatches(a.cfg.MatchesFilename)
+	if err != nil {
+		return fmt.Errorf("error reading matches file: %s", err.Error())
+	}
+
+	a.decisions, err = readDecisions(a.cfg.DecisionsFilename)
+	if err != nil {
+		return fmt.Errorf("error reading decisions file: %s", err.Error())
+	}
+
+	var only map[string]bool
+	if checksums != nil {
+		matches, only, err = a.affectedMatches(matches, checksums)
+		if err != nil {
+			return fmt.Errorf("not syncing markers: %s", err.Error())
+		}
+	}
+
+	changes, err := a.syncMarkers(matches, only)
+	if err != nil {
+		return err
+	}
+
+	log.Infof("Synced markers: %s", changes)
+	return nil
+}
+
+// affectedMatches returns the matches needed to sync the markers of the
+// scenes with the checksums and their duplicates, and the ids of those
+// scenes.
+func (a *api) affectedMatches(matches matchResults, checksums []string) (matchResults, map[string]bool, error) {
+	subjects := make(map[string]bool)
+	for _, c := range checksums {
+		subjects[c] = true
+	}
+
+	affected := make(map[string]bool)
+	for _, r := range matches {
+		if subjects[r.Subject] || subjects[r.Other] {
+			affected[r.Subject] = true
+			affected[r.Other] = true
+		}
+	}
+
+	// the markers of a duplicate include those of its other matches
+	matches = matches.filter(func(r *matchResult) bool {
+		return affected[r.Subject] || affected[r.Other]
+	})
+
+	ids := make(map[string]bool)
+	for c := range affected {
+		s, err := a.markerScene(c)
+		if err != nil {
+			return nil, nil, err
+		}
+		if s != nil {
+			ids[fmt.Sprint(s.ID)] = true
+		}
+	}
+
+	return matches, ids, nil
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+)
+
+// the tiles are divided into a grid of cells to detect static regions
+const (
+	staticGridCols = 16
+	staticGridRows = 9
+)
+
+// staticTolerance is the maximum standard deviation of the mean luminance of
+// a cell across the tiles for it to be static.
+const staticTolerance = 0.02 * 65535
+
+// staticMinDetail is the minimum mean standard deviation of the luminance
+// within a static cell. Static cells without detail are plain backgrounds
+// rather than overlays.
+const staticMinDetail = 0.03 * 65535
+
+// maxStaticFraction is the maximum fraction of the cells that may be static.
+// If more cells are static, then the video itself is mostly static and no
+// regions are excluded.
+const maxStaticFraction = 0.25
+
+// maskRect is a region of the video frame that is excluded from hashing, as
+// fractions of the frame width and height.
+type maskRect struct {
+	X      float64 `yaml:"x"`
+	Y      float64 `yaml:"y"`
+	Width  float64 `yaml:"width"`
+	Height float64 `yaml:"height"`
+}
+
+func (m maskRect) validate() error {
+	if m.X < 0 || m.Y < 0 || m.Width <= 0 || m.Height <= 0 || m.X+m.Width > 1 || m.Y+m.Height > 1 {
+		return fmt.Errorf("invalid mask %v: values must be fractions of the frame", m)
+	}
+
+	return nil
+}
+
+// rect returns the region of a tile of the provided size.
+func (m maskRect) rect(w, h int) image.Rectangle {
+	fw := float64(w)
+	fh := float64(h)
+	ret := image.Rect(int(m.X*fw), int(m.Y*fh), int(math.Ceil((m.X+m.Width)*fw)), int(math.Ceil((m.Y+m.Height)*fh)))
+	return ret.Intersect(image.Rect(0, 0, w, h))
+}
+
+// applyMasks returns a copy of the sprite with the regions of each tile
+// filled with the mean colour of the rest of the tile. regions are relative
+// to the tile origin.
+func applyMasks(img image.Image, cols, rows int, regions []image.Rectangle) image.Image {
+	bounds := img.Bounds()
+	ret := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(ret, ret.Bounds(), img, bounds.Min, draw.Src)
+
+	w := bounds.Dx() / cols
+	h := bounds.Dy() / rows
+	if w == 0 || h == 0 {
+		return ret
+	}
+
+	masked := make([]bool, w*h)
+	for _, r := range regions {
+		r = r.Intersect(image.Rect(0, 0, w, h))
+		for y := r.Min.Y; y < r.Max.Y; y++ {
+			for x := r.Min.X; x < r.Max.X; x++ {
+				masked[y*w+x] = true
+			}
+		}
+	}
+
+	for ty := 0; ty < rows; ty++ {
+		for tx := 0; tx < cols; tx++ {
+			ox, oy := tx*w, ty*h
+
+			var r, g, b, n uint64
+			for y := 0; y < h; y++ {
+				for x := 0; x < w; x++ {
+					if !masked[y*w+x] {
+						c := ret.RGBAAt(ox+x, oy+y)
+						r += uint64(c.R)
+						g += uint64(c.G)
+						b += uint64(c.B)
+						n++
+					}
+				}
+			}
+
+			fill := color.RGBA{A: 255}
+			if n > 0 {
+				fill = color.RGBA{uint8(r / n), uint8(g / n), uint8(b / n), 255}
+			}
+
+			for y := 0; y < h; y++ {
+				for x := 0; x < w; x++ {
+					if masked[y*w+x] {
+						ret.SetRGBA(ox+x, oy+y, fill)
+					}
+				}
+			}
+		}
+	}
+
+	return ret
+}
+
+// staticRegions returns the regions of the tiles that do not change
+// throughout the sprite, such as watermarks and logos, relative to the tile
+// origin. Adjacent static cells of each row of the cell grid are merged.
+func staticRegions(tiles []image.Image) []image.Rectangle {
+	if len(tiles) < 2 {
+		return nil
+	}
+
+	tb := tiles[0].Bounds()
+	w, h := tb.Dx(), tb.Dy()
+	cell := func(cx, cy int) image.Rectangle {
+		return image.Rect(cx*w/staticGridCols, cy*h/staticGridRows, (cx+1)*w/staticGridCols, (cy+1)*h/staticGridRows)
+	}
+
+	static := make([][]bool, staticGridRows)
+	count := 0
+	for cy := 0; cy < staticGridRows; cy++ {
+		static[cy] = make([]bool, staticGridCols)
+		for cx := 0; cx < staticGridCols; cx++ {
+			r := cell(cx, cy)
+			if r.Empty() {
+				continue
+			}
+
+			var means []float64
+			detail := 0.0
+			for _, t := range tiles {
+				var values []float64
+				min := t.Bounds().Min
+				for y := r.Min.Y; y < r.Max.Y; y++ {
+					for x := r.Min.X; x < r.Max.X; x++ {
+						values = append(values, luminance(t, min.X+x, min.Y+y))
+					}
+				}
+
+				mean, stdDev := meanStdDev(values)
+				means = append(means, mean)
+				detail += stdDev
+			}
+
+			_, variation := meanStdDev(means)
+			if variation <= staticTolerance && detail/float64(len(tiles)) >= staticMinDetail {
+				static[cy][cx] = true
+				count++
+			}
+		}
+	}
+
+	if count == 0 || float64(count) > maxStaticFraction*staticGridCols*staticGridRows {
+		return nil
+	}
+
+	// overlays are not aligned to the cells, so the cells around the static
+	// cells, which are only partially static, are included
+	dilated := make([][]bool, staticGridRows)
+	for cy := range dilated {
+		dilated[cy] = make([]bool, staticGridCols)
+		for cx := range dilated[cy] {
+			for y := maxInt(cy-1, 0); y <= minInt(cy+1, staticGridRows-1); y++ {
+				for x := maxInt(cx-1, 0); x <= minInt(cx+1, staticGridCols-1); x++ {
+					dilated[cy][cx] = dilated[cy][cx] || static[y][x]
+				}
+			}
+		}
+	}
+	static = dilated
+
+	var ret []image.Rectangle
+	for cy := 0; cy < staticGridRows; cy++ {
+		for cx := 0; cx < staticGridCols; cx++ {
+			if !static[cy][cx] {
+				continue
+			}
+
+			r := cell(cx, cy)
+			for cx+1 < staticGridCols && static[cy][cx+1] {
+				cx++
+				r = r.Union(cell(cx, cy))
+			}
+			ret = append(ret, r)
+		}
+	}
+
+	return ret
+}
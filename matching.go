@@ -1,27 +1,329 @@
 package main
 
+import (
+	"fmt"
+	"math"
+
+	"github.com/rivo/duplo"
+)
+
+// matchCriteria are the conditions that a match must satisfy for the sprites
+// to be considered duplicates.
+type matchCriteria struct {
+	Threshold int `yaml:"threshold"`
+
+	// limits of the individual match metrics. 0 disables the limit.
+	MaxRatioDiff         float64 `yaml:"max_ratio_diff"`
+	MaxDHashDistance     int     `yaml:"max_dhash_distance"`
+	MaxHistogramDistance int     `yaml:"max_histogram_distance"`
+}
+
+// rules returns the result of each enabled rule for the match. m is nil if
+// the sprites have no similarity.
+func (c matchCriteria) rules(m *duplo.Match) []ruleResult {
+	scoreRule := ruleResult{
+		name:   "score",
+		detail: fmt.Sprintf("no similarity < threshold %d", c.Threshold),
+	}
+	if m != nil {
+		scoreRule.passed = m.Score <= float64(-c.Threshold)
+		scoreRule.detail = fmt.Sprintf("%.f >= threshold %d", -m.Score, c.Threshold)
+		if !scoreRule.passed {
+			scoreRule.detail = fmt.Sprintf("%.f < threshold %d", -m.Score, c.Threshold)
+		}
+	}
+	ret := []ruleResult{scoreRule}
+
+	if m == nil {
+		return ret
+	}
+
+	if c.MaxRatioDiff > 0 {
+		ret = append(ret, maxRule("ratio_diff", m.RatioDiff <= c.MaxRatioDiff, fmt.Sprintf("%.4f", m.RatioDiff), fmt.Sprintf("%.4f", c.MaxRatioDiff)))
+	}
+	if c.MaxDHashDistance > 0 {
+		ret = append(ret, maxRule("dhash_distance", m.DHashDistance <= c.MaxDHashDistance, m.DHashDistance, c.MaxDHashDistance))
+	}
+	if c.MaxHistogramDistance > 0 {
+		ret = append(ret, maxRule("histogram_distance", m.HistogramDistance <= c.MaxHistogramDistance, m.HistogramDistance, c.MaxHistogramDistance))
+	}
+
+	return ret
+}
+
+func maxRule(name string, passed bool, value, max interface{}) ruleResult {
+	op := "<="
+	if !passed {
+		op = ">"
+	}
+
+	return ruleResult{
+		name:   name,
+		passed: passed,
+		detail: fmt.Sprintf("%v %s max %v", value, op, max),
+	}
+}
+
+// isMatch returns true if the match satisfies all of the criteria.
+func (c matchCriteria) isMatch(m *duplo.Match) bool {
+	if m == nil || m.Score > float64(-c.Threshold) {
+		return false
+	}
+
+	return (c.MaxRatioDiff <= 0 || m.RatioDiff <= c.MaxRatioDiff) &&
+		(c.MaxDHashDistance <= 0 || m.DHashDistance <= c.MaxDHashDistance) &&
+		(c.MaxHistogramDistance <= 0 || m.HistogramDistance <= c.MaxHistogramDistance)
+}
+
 type matchInfo struct {
 	other      string
 	otherScene *Scene
 	score      float64
+	mirrored   bool
+	partial    bool
+
+	// phash is true if the scenes were matched by their phashes, which
+	// differ by phashDistance. score is the sprite score, if the sprites
+	// also matched.
+	phash         bool
+	phashDistance int
 }
 
 type matchInfoMap map[string][]matchInfo
 
-func (m *matchInfoMap) add(subject, match string, score float64) {
+// add adds the match to both sprites.
+func (m *matchInfoMap) add(subject, match string, score float64, mirrored, partial bool) {
 	existing := (*m)[subject]
 	existing = append(existing, matchInfo{
-		other: match,
-		score: score,
+		other:    match,
+		score:    score,
+		mirrored: mirrored,
+		partial:  partial,
 	})
 
 	(*m)[subject] = existing
 
 	existing = (*m)[match]
 	existing = append(existing, matchInfo{
-		other: subject,
-		score: score,
+		other:    subject,
+		score:    score,
+		mirrored: mirrored,
+		partial:  partial,
 	})
 
 	(*m)[match] = existing
 }
+
+// addPhash adds the phash match to both sprites. score is the score of the
+// sprite match of the pair, or 0 if the sprites did not match.
+func (m *matchInfoMap) addPhash(subject, match string, distance int, score float64) {
+	(*m)[subject] = append((*m)[subject], matchInfo{
+		other:         match,
+		score:         score,
+		phash:         true,
+		phashDistance: distance,
+	})
+
+	(*m)[match] = append((*m)[match], matchInfo{
+		other:         subject,
+		score:         score,
+		phash:         true,
+		phashDistance: distance,
+	})
+}
+
+// matchResult is a match found between two sprites, as stored in the matches
+// file.
+type matchResult struct {
+	Subject           string  `json:"subject"`
+	Other             string  `json:"other"`
+	Score             float64 `json:"score"`
+	RatioDiff         float64 `json:"ratio_diff"`
+	DHashDistance     int     `json:"dhash_distance"`
+	HistogramDistance int     `json:"histogram_distance"`
+
+	// Mirrored is true if the other sprite is a mirrored copy of the subject
+	Mirrored bool `json:"mirrored,omitempty"`
+
+	// aspect ratios of the content of the sprites, if known
+	SubjectAspectRatio float64 `json:"subject_aspect_ratio,omitempty"`
+	OtherAspectRatio   float64 `json:"other_aspect_ratio,omitempty"`
+
+	// Segments are the matching parts of the scenes, if known
+	Segments []matchSegment `json:"segments,omitempty"`
+
+	// Partial is true if the durations of the scenes differ too much for
+	// them to be whole scene duplicates, so only the segments match
+	Partial bool `json:"partial,omitempty"`
+
+	// DurationScore is the score scaled by the ratio of the durations of the
+	// scenes, if duration scoring is enabled and both durations are known
+	DurationScore float64 `json:"duration_score,omitempty"`
+}
+
+// aspectRatioTolerance is the maximum relative difference between content
+// aspect ratios for them to be considered the same.
+const aspectRatioTolerance = 0.05
+
+// aspectRatioChanged returns true if the content aspect ratios of both
+// sprites are known and differ.
+func (r *matchResult) aspectRatioChanged() bool {
+	if r.SubjectAspectRatio == 0 || r.OtherAspectRatio == 0 {
+		return false
+	}
+
+	return math.Abs(r.SubjectAspectRatio-r.OtherAspectRatio)/r.OtherAspectRatio > aspectRatioTolerance
+}
+
+func newMatchResult(subject string, m *duplo.Match, mirrored bool) *matchResult {
+	return &matchResult{
+		Subject:           subject,
+		Other:             m.ID.(string),
+		Score:             m.Score,
+		RatioDiff:         m.RatioDiff,
+		DHashDistance:     m.DHashDistance,
+		HistogramDistance: m.HistogramDistance,
+		Mirrored:          mirrored,
+	}
+}
+
+type matchResults []*matchResult
+
+// set replaces any existing results involving subject with the provided
+// matches. mirrored contains the keys of the pairs matched using the
+// mirrored hash.
+func (r matchResults) set(subject string, matches duplo.Matches, mirrored map[string]bool) matchResults {
+	ret := r.filter(func(m *matchResult) bool {
+		return m.Subject != subject && m.Other != subject
+	})
+
+	for _, m := range matches {
+		ret = append(ret, newMatchResult(subject, m, mirrored[pairKey(subject, m.ID.(string))]))
+	}
+
+	return ret
+}
+
+// notes returns a description of the notable properties of the match, to be
+// appended to its score.
+func (r *matchResult) notes() string {
+	ret := ""
+	if r.Mirrored {
+		ret += ", mirrored"
+	}
+	if r.aspectRatioChanged() {
+		ret += fmt.Sprintf(", aspect ratio %.2f to %.2f", r.SubjectAspectRatio, r.OtherAspectRatio)
+	}
+	if r.Partial {
+		ret += ", partial"
+	}
+	if r.DurationScore != 0 && r.DurationScore != r.Score {
+		ret += fmt.Sprintf(", duration score %.f", -r.DurationScore)
+	}
+	if len(r.Segments) > 0 {
+		ret += ", at " + formatSegments(r.Segments)
+	}
+
+	return ret
+}
+
+// setAspectRatios sets the content aspect ratios of the sprites of the
+// results from the sprite metadata.
+func (r matchResults) setAspectRatios(meta spriteMetas) {
+	for _, m := range r {
+		if sm := meta[m.Subject]; sm != nil {
+			m.SubjectAspectRatio = sm.aspectRatio()
+		}
+		if om := meta[m.Other]; om != nil {
+			m.OtherAspectRatio = om.aspectRatio()
+		}
+	}
+}
+
+// setSegments sets the matching segments of the results that were aligned.
+// segments is keyed by subject and other sprite names separated by |.
+func (r matchResults) setSegments(segments map[string][]matchSegment) {
+	for _, m := range r {
+		if s, found := segments[m.Subject+"|"+m.Other]; found {
+			m.Segments = s
+		}
+	}
+}
+
+// setPartial marks the results whose pairs are partial matches. partial is
+// keyed by pair.
+func (r matchResults) setPartial(partial map[string]bool) {
+	for _, m := range r {
+		if p, found := partial[pairKey(m.Subject, m.Other)]; found {
+			m.Partial = p
+		}
+	}
+}
+
+// setDurationScores sets the duration scores of the results whose scores
+// were scaled in this run. scores is keyed by pair.
+func (r matchResults) setDurationScores(scores map[string]float64) {
+	for _, m := range r {
+		if s, found := scores[pairKey(m.Subject, m.Other)]; found {
+			m.DurationScore = s
+		}
+	}
+}
+
+// filter returns the results for which fn returns true.
+func (r matchResults) filter(fn func(m *matchResult) bool) matchResults {
+	var ret matchResults
+	for _, m := range r {
+		if fn(m) {
+			ret = append(ret, m)
+		}
+	}
+
+	return ret
+}
+
+// groups returns the group number of each sprite in the results. Sprites that
+// are matched directly or indirectly are in the same group. Groups are
+// numbered from 1, in the order of the results.
+func (r matchResults) groups() map[string]int {
+	ret := make(map[string]int)
+	next := 1
+
+	// merge groups when a match joins two existing groups
+	for _, m := range r {
+		sg := ret[m.Subject]
+		og := ret[m.Other]
+
+		switch {
+		case sg == 0 && og == 0:
+			ret[m.Subject] = next
+			ret[m.Other] = next
+			next++
+		case sg == 0:
+			ret[m.Subject] = og
+		case og == 0:
+			ret[m.Other] = sg
+		case sg != og:
+			for k, v := range ret {
+				if v == og {
+					ret[k] = sg
+				}
+			}
+		}
+	}
+
+	// renumber so that there are no gaps
+	renumbered := make(map[int]int)
+	for _, m := range r {
+		g := ret[m.Subject]
+		if renumbered[g] == 0 {
+			renumbered[g] = len(renumbered) + 1
+		}
+	}
+
+	for k, v := range ret {
+		ret[k] = renumbered[v]
+	}
+
+	return ret
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+
+	"stash-plugin-duplicate-finder/internal/plugin/common/log"
+)
+
+// phashMatch is a pair of scenes with similar phashes.
+type phashMatch struct {
+	// subject and other are the sprite names of the scenes
+	subject string
+	other   string
+
+	distance int
+
+	// spriteScore is the score of the sprite match of the pair from the
+	// matches file, or 0 if the sprites did not match
+	spriteScore float64
+}
+
+// minPhashChunkBits is the width of the narrowest chunks that phashes are
+// split into for matching. With narrower chunks most phashes share a chunk,
+// and comparing every pair is faster.
+const minPhashChunkBits = 8
+
+// phashChunks splits the phash into n chunks.
+func phashChunks(phash uint64, n int) []uint64 {
+	ret := make([]uint64, n)
+	for c := range ret {
+		lo := uint(c * 64 / n)
+		hi := uint((c + 1) * 64 / n)
+		ret[c] = (phash >> lo) & (^uint64(0) >> (64 - (hi - lo)))
+	}
+
+	return ret
+}
+
+// findPhashMatches returns the pairs of phashes within maxDistance of each
+// other, ordered by distance and then by name. phashes is keyed by sprite
+// name. Matching ends early if stopping returns true.
+//
+// Rather than comparing every pair, the phashes are split into
+// maxDistance+1 chunks. Two phashes within maxDistance of each other differ
+// in at most maxDistance chunks, so they are equal in at least one chunk,
+// and only the phashes that share a chunk are compared.
+func findPhashMatches(phashes map[string]uint64, maxDistance int, stopping func() bool) []phashMatch {
+	if maxDistance < 0 {
+		return nil
+	}
+
+	var names []string
+	for name := range phashes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	n := maxDistance + 1
+	if 64/n < minPhashChunkBits {
+		n = 0
+	}
+
+	// the indexes of the names in each bucket are in ascending order
+	values := make([]uint64, len(names))
+	chunks := make([][]uint64, len(names))
+	buckets := make([]map[uint64][]int, n)
+	for c := range buckets {
+		buckets[c] = make(map[uint64][]int)
+	}
+	for i, name := range names {
+		values[i] = phashes[name]
+		chunks[i] = phashChunks(values[i], n)
+		for c, k := range chunks[i] {
+			buckets[c][k] = append(buckets[c][k], i)
+		}
+	}
+
+	var ret []phashMatch
+	compare := func(i, j int) {
+		if d := hammingDistance(values[i], values[j]); d <= maxDistance {
+			ret = append(ret, phashMatch{
+				subject:  names[i],
+				other:    names[j],
+				distance: d,
+			})
+		}
+	}
+
+	for i := range names {
+		if stopping() {
+			break
+		}
+		log.Progress(float64(i) / float64(len(names)))
+
+		if n == 0 {
+			for j := i + 1; j < len(names); j++ {
+				compare(i, j)
+			}
+			continue
+		}
+
+		for c, k := range chunks[i] {
+			bucket := buckets[c][k]
+			for _, j := range bucket[sort.SearchInts(bucket, i+1):] {
+				// the pair is compared in the first chunk that is equal
+				if !sharesChunk(chunks[i][:c], chunks[j][:c]) {
+					compare(i, j)
+				}
+			}
+		}
+	}
+
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].distance != ret[j].distance {
+			return ret[i].distance < ret[j].distance
+		}
+		if ret[i].subject != ret[j].subject {
+			return ret[i].subject < ret[j].subject
+		}
+		return ret[i].other < ret[j].other
+	})
+
+	return ret
+}
+
+// sharesChunk returns whether any chunk of a is equal to the chunk of b at
+// the same position.
+func sharesChunk(a, b []uint64) bool {
+	for c := range a {
+		if a[c] == b[c] {
+			return true
+		}
+	}
+
+	return false
+}
+
+// getPhashes returns the phash of each scene on the server that has one,
+// keyed by sprite name.
+func (a *api) getPhashes() (map[string]uint64, error) {
+	ret := make(map[string]uint64)
+	count := 0
+	for page := 1; ; page++ {
+		result, err := findScenePhashes(a.client, page, prefetchPageSize)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, s := range result.Scenes {
+			name := s.getHash(a.cache.algorithm)
+			if s.Phash == nil || *s.Phash == "" || name == "" {
+				continue
+			}
+
+			v, err := strconv.ParseUint(string(*s.Phash), 16, 64)
+			if err != nil {
+				log.Warnf("Invalid phash %q of scene %s", string(*s.Phash), s.ID)
+				continue
+			}
+			ret[name] = v
+		}
+
+		count += len(result.Scenes)
+		if len(result.Scenes) < prefetchPageSize || count >= int(result.Count) {
+			break
+		}
+	}
+
+	return ret, nil
+}
+
+// findPhashDuplicates matches the scenes on the server by the phashes
+// generated by stash, instead of hashing their sprites. Each match includes
+// the score of the sprite match of the pair from the matches file, if any.
+// If phashes are combined with sprites, only pairs that also matched by
+// their sprites are duplicates. The duplicates are logged and handled as in
+// findDuplicates.
+func (a *api) findPhashDuplicates() ([]phashMatch, error) {
+	phashes, err := a.getPhashes()
+	if err != nil {
+		return nil, fmt.Errorf("error getting scene phashes: %s", err.Error())
+	}
+
+	log.Infof("Matching %d scene phashes...", len(phashes))
+
+	sprites, err := readMatches(a.cfg.MatchesFilename)
+	if err != nil {
+		return nil, fmt.Errorf("error reading matches file: %s", err.Error())
+	}
+
+	a.decisions, err = readDecisions(a.cfg.DecisionsFilename)
+	if err != nil {
+		return nil, fmt.Errorf("error reading decisions file: %s", err.Error())
+	}
+
+	spriteScores := make(map[string]float64)
+	for _, r := range sprites {
+		spriteScores[pairKey(r.Subject, r.Other)] = r.Score
+	}
+
+	var ret []phashMatch
+	m := make(matchInfoMap)
+	for _, p := range findPhashMatches(phashes, a.cfg.MaxPhashDistance, a.isStopping) {
+		if a.isStopping() {
+			break
+		}
+
+		if a.sameScene(p.subject, p.other) || a.decisions.isIgnored(p.subject, p.other) {
+			continue
+		}
+
+		p.spriteScore = spriteScores[pairKey(p.subject, p.other)]
+		if a.cfg.CombinePhash && p.spriteScore == 0 {
+			log.Debugf("Excluding %s - %s: phash distance %d but sprites do not match", p.subject, p.other, p.distance)
+			continue
+		}
+
+		ret = append(ret, p)
+		a.logPhashDuplicate(p)
+		m.addPhash(p.subject, p.other, p.distance, p.spriteScore)
+		a.handleDuplicate(m, p.subject, true)
+	}
+
+	log.Infof("Found %d phash matches", len(ret))
+	a.logFailures()
+	return ret, nil
+}
+
+func (a *api) logPhashDuplicate(p phashMatch) {
+	subject, err := a.cache.get(p.subject)
+	if err != nil {
+		a.addSceneError(p.subject, err)
+		return
+	}
+
+	other, err := a.cache.get(p.other)
+	if err != nil {
+		a.addSceneError(p.other, err)
+		return
+	}
+
+	if p.spriteScore != 0 {
+		log.Infof("Duplicate: %s - %s (phash distance: %d, score: %.f)", subject.ID, other.ID, p.distance, -p.spriteScore)
+	} else {
+		log.Infof("Duplicate: %s - %s (phash distance: %d)", subject.ID, other.ID, p.distance)
+	}
+}
+
+// writePhashCSVReport writes the phash matches as CSV, including the scene
+// ids if cache is not nil.
+func writePhashCSVReport(w io.Writer, matches []phashMatch, cache *sceneCache) error {
+	cw := csv.NewWriter(w)
+
+	header := []string{"subject", "other", "phash_distance", "score"}
+	if cache != nil {
+		for _, prefix := range []string{"subject", "other"} {
+			header = append(header, prefix+"_id", prefix+"_path", prefix+"_duration", prefix+"_resolution")
+		}
+	}
+
+	if err := cw.Write(header); err != nil {
+		return err
+	}
+
+	for _, m := range matches {
+		score := ""
+		if m.spriteScore != 0 {
+			score = fmt.Sprintf("%.f", -m.spriteScore)
+		}
+
+		row := []string{
+			m.subject,
+			m.other,
+			strconv.Itoa(m.distance),
+			score,
+		}
+
+		if cache != nil {
+			row = append(row, sceneCSVColumns(cache, m.subject)...)
+			row = append(row, sceneCSVColumns(cache, m.other)...)
+		}
+
+		if err := cw.Write(row); err != nil {
+			return err
+		}
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestHammingDistance(t *testing.T) {
+	tests := []struct {
+		a, b uint64
+		want int
+	}{
+		{0, 0, 0},
+		{0xffffffffffffffff, 0xffffffffffffffff, 0},
+		{0, 1, 1},
+		{0, 0x8000000000000000, 1},
+		{0, 0xffffffffffffffff, 64},
+		{0xf0f0f0f0f0f0f0f0, 0x0f0f0f0f0f0f0f0f, 64},
+		{0xc000000000000003, 0x0000000000000000, 4},
+		{0x1234567890abcdef, 0x1234567890abcdee, 1},
+	}
+
+	for _, tt := range tests {
+		if got := hammingDistance(tt.a, tt.b); got != tt.want {
+			t.Errorf("hammingDistance(%x, %x) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+		if got := hammingDistance(tt.b, tt.a); got != tt.want {
+			t.Errorf("hammingDistance(%x, %x) = %d, want %d", tt.b, tt.a, got, tt.want)
+		}
+	}
+}
+
+func notStopping() bool {
+	return false
+}
+
+func TestFindPhashMatches(t *testing.T) {
+	phashes := map[string]uint64{
+		"a": 0x0000000000000000,
+		"b": 0x0000000000000003,
+		"c": 0x000000000000000f,
+		"d": 0xffffffffffffffff,
+		"e": 0xfffffffffffffffe,
+		"f": 0x0000000000000000,
+	}
+
+	tests := []struct {
+		name        string
+		maxDistance int
+		want        []phashMatch
+	}{
+		{
+			name:        "identical only",
+			maxDistance: 0,
+			want: []phashMatch{
+				{subject: "a", other: "f", distance: 0},
+			},
+		},
+		{
+			name:        "ordered by distance then name",
+			maxDistance: 2,
+			want: []phashMatch{
+				{subject: "a", other: "f", distance: 0},
+				{subject: "d", other: "e", distance: 1},
+				{subject: "a", other: "b", distance: 2},
+				{subject: "b", other: "c", distance: 2},
+				{subject: "b", other: "f", distance: 2},
+			},
+		},
+		{
+			name:        "larger distance",
+			maxDistance: 4,
+			want: []phashMatch{
+				{subject: "a", other: "f", distance: 0},
+				{subject: "d", other: "e", distance: 1},
+				{subject: "a", other: "b", distance: 2},
+				{subject: "b", other: "c", distance: 2},
+				{subject: "b", other: "f", distance: 2},
+				{subject: "a", other: "c", distance: 4},
+				{subject: "c", other: "f", distance: 4},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := findPhashMatches(phashes, tt.maxDistance, notStopping)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("findPhashMatches() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	if got := findPhashMatches(nil, 4, notStopping); len(got) != 0 {
+		t.Errorf("findPhashMatches(nil) = %v, want none", got)
+	}
+}
+
+func TestFindPhashMatchesAllPairs(t *testing.T) {
+	// groups of phashes a few bits apart, so that pairs at each distance are
+	// found in different chunks
+	phashes := make(map[string]uint64)
+	for g := 0; g < 8; g++ {
+		base := testTileHash(g)
+		for i := 0; i < 8; i++ {
+			phashes[fmt.Sprintf("%d-%d", g, i)] = base ^ testTileHash(100+g*8+i)&0x0101010101010101
+		}
+	}
+
+	for _, maxDistance := range []int{0, 1, 3, 8, 20, 64} {
+		var want []phashMatch
+		names := make([]string, 0, len(phashes))
+		for name := range phashes {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for i, name := range names {
+			for _, other := range names[i+1:] {
+				if d := hammingDistance(phashes[name], phashes[other]); d <= maxDistance {
+					want = append(want, phashMatch{subject: name, other: other, distance: d})
+				}
+			}
+		}
+		sort.SliceStable(want, func(i, j int) bool {
+			return want[i].distance < want[j].distance
+		})
+
+		got := findPhashMatches(phashes, maxDistance, notStopping)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("findPhashMatches(%d) found %d pairs, want %d", maxDistance, len(got), len(want))
+		}
+	}
+}
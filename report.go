@@ -0,0 +1,207 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Valid report formats
+const (
+	reportFormatCSV       = "csv"
+	reportFormatHTML      = "html"
+	reportFormatJSON      = "json"
+	reportFormatJSONLines = "jsonl"
+)
+
+var reportFormats = []string{
+	reportFormatCSV,
+	reportFormatHTML,
+	reportFormatJSON,
+	reportFormatJSONLines,
+}
+
+func isValidReportFormat(format string) bool {
+	for _, f := range reportFormats {
+		if f == format {
+			return true
+		}
+	}
+
+	return false
+}
+
+// report contains the match results and the details needed to write them.
+type report struct {
+	results matchResults
+
+	// cache is used to include scene metadata, if not nil
+	cache *sceneCache
+
+	// spriteDir is the directory containing the sprite files. Sprite images
+	// are not included in the report if empty.
+	spriteDir string
+
+	// serverURL is the base URL of the stash server, used to link to the
+	// scene pages. Links are not included if empty.
+	serverURL string
+
+	// decisions are the review decisions, used to include keeper choices
+	decisions decisions
+}
+
+// write writes the report to w in the provided format.
+func (r report) write(w io.Writer, format string) error {
+	switch format {
+	case reportFormatCSV:
+		return writeCSVReport(w, r.results, r.cache)
+	case reportFormatHTML:
+		return writeHTMLReport(w, r)
+	case reportFormatJSON:
+		return writeJSONReport(w, r)
+	case reportFormatJSONLines:
+		return writeJSONLinesReport(w, r)
+	}
+
+	return fmt.Errorf("invalid format: %s", format)
+}
+
+// writeFile writes the report to the named file in the provided format.
+func (r report) writeFile(fn string, format string) error {
+	f, err := os.Create(fn)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return r.write(f, format)
+}
+
+func sceneURL(serverURL string, id string) string {
+	return strings.TrimSuffix(serverURL, "/") + "/scenes/" + id
+}
+
+// sortedByGroup returns the whole scene results sorted by group and then by
+// score, along with the group of each sprite. Partial matches are not
+// grouped.
+func sortedByGroup(results matchResults) (matchResults, map[string]int) {
+	ret := results.filter(func(m *matchResult) bool {
+		return !m.Partial
+	})
+	groups := ret.groups()
+
+	sort.SliceStable(ret, func(i, j int) bool {
+		gi := groups[ret[i].Subject]
+		gj := groups[ret[j].Subject]
+		if gi != gj {
+			return gi < gj
+		}
+
+		return ret[i].Score < ret[j].Score
+	})
+
+	return ret, groups
+}
+
+// sortedPartial returns the partial matches of the results sorted by score.
+func sortedPartial(results matchResults) matchResults {
+	ret := results.filter(func(m *matchResult) bool {
+		return m.Partial
+	})
+
+	sort.SliceStable(ret, func(i, j int) bool {
+		return ret[i].Score < ret[j].Score
+	})
+
+	return ret
+}
+
+func writeCSVReport(w io.Writer, results matchResults, cache *sceneCache) error {
+	cw := csv.NewWriter(w)
+
+	header := []string{"group", "subject", "other", "score", "ratio_diff", "dhash_distance", "histogram_distance", "mirrored", "subject_aspect_ratio", "other_aspect_ratio", "segments", "partial", "duration_score"}
+	if cache != nil {
+		for _, prefix := range []string{"subject", "other"} {
+			header = append(header, prefix+"_id", prefix+"_path", prefix+"_duration", prefix+"_resolution")
+		}
+	}
+
+	if err := cw.Write(header); err != nil {
+		return err
+	}
+
+	// partial matches follow the groups, without a group number
+	sorted, groups := sortedByGroup(results)
+	for _, r := range append(sorted, sortedPartial(results)...) {
+		group := ""
+		if !r.Partial {
+			group = strconv.Itoa(groups[r.Subject])
+		}
+
+		row := []string{
+			group,
+			r.Subject,
+			r.Other,
+			fmt.Sprintf("%.f", -r.Score),
+			fmt.Sprintf("%.4f", r.RatioDiff),
+			strconv.Itoa(r.DHashDistance),
+			strconv.Itoa(r.HistogramDistance),
+			strconv.FormatBool(r.Mirrored),
+			formatAspectRatio(r.SubjectAspectRatio),
+			formatAspectRatio(r.OtherAspectRatio),
+			formatSegments(r.Segments),
+			strconv.FormatBool(r.Partial),
+			formatDurationScore(r.DurationScore),
+		}
+
+		if cache != nil {
+			row = append(row, sceneCSVColumns(cache, r.Subject)...)
+			row = append(row, sceneCSVColumns(cache, r.Other)...)
+		}
+
+		if err := cw.Write(row); err != nil {
+			return err
+		}
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
+
+// formatDurationScore returns the duration score as a string, or an empty
+// string if the score was not scaled.
+func formatDurationScore(score float64) string {
+	if score == 0 {
+		return ""
+	}
+
+	return fmt.Sprintf("%.f", -score)
+}
+
+// formatAspectRatio returns the aspect ratio as a string, or an empty string
+// if it is not known.
+func formatAspectRatio(v float64) string {
+	if v == 0 {
+		return ""
+	}
+
+	return fmt.Sprintf("%.4f", v)
+}
+
+func sceneCSVColumns(cache *sceneCache, name string) []string {
+	s, err := cache.get(name)
+	if err != nil {
+		return []string{"", "", "", ""}
+	}
+
+	return []string{
+		fmt.Sprint(s.ID),
+		string(s.Path),
+		s.File.durationString(),
+		s.File.resolutionString(),
+	}
+}
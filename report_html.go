@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"html/template"
+	"image/jpeg"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/nfnt/resize"
+)
+
+// width of the sprite images in the html report
+const htmlSpriteWidth = 480
+
+// htmlTemplatePartials are the templates shared by the html report and the
+// review page served by the serve command.
+const htmlTemplatePartials = `{{define "style"}}
+body { font-family: sans-serif; background: #202b33; color: #f5f8fa; margin: 1em 2em; }
+a { color: #48aff0; }
+.group { border-top: 1px solid #5c7080; padding: 1em 0; }
+.scenes { display: flex; flex-wrap: wrap; gap: 1em; }
+.scene { width: {{.SpriteWidth}}px; }
+.scene img { width: 100%; display: block; }
+.scene table, .matches { font-size: 0.9em; border-collapse: collapse; }
+.scene td, .matches td, .matches th { padding: 0.1em 0.5em 0.1em 0; text-align: left; vertical-align: top; }
+.path { word-break: break-all; }
+{{end}}{{define "scene"}}
+<div class="scene">
+{{if .Image}}<img src="{{.Image}}" alt="{{.Name}}" loading="lazy">{{end}}
+<table>
+<tr><td>Sprite</td><td>{{.Name}}</td></tr>
+{{if .ID}}<tr><td>Scene</td><td>{{if .URL}}<a href="{{.URL}}" target="_blank">{{.ID}}</a>{{else}}{{.ID}}{{end}}</td></tr>{{end}}
+{{if .Path}}<tr><td>Path</td><td class="path">{{.Path}}</td></tr>{{end}}
+{{if .Resolution}}<tr><td>Resolution</td><td>{{.Resolution}}</td></tr>{{end}}
+{{if .Duration}}<tr><td>Duration</td><td>{{.Duration}}</td></tr>{{end}}
+{{if .Size}}<tr><td>Size</td><td>{{.Size}}</td></tr>{{end}}
+</table>
+</div>
+{{end}}{{define "partial description"}}<p>Scenes with matching segments whose durations differ too much for them to be whole scene duplicates.</p>{{end}}`
+
+var htmlReportTemplate = template.Must(template.New("report").Parse(htmlTemplatePartials + `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Duplicate finder report</title>
+<style>
+{{template "style" .}}
+</style>
+</head>
+<body>
+<h1>Duplicate finder report</h1>
+<p>{{len .Groups}} groups, {{.MatchCount}} matches{{if .PartialMatches}}, {{len .PartialMatches}} partial matches{{end}}</p>
+{{range .Groups}}
+<div class="group" id="group-{{.ID}}">
+<h2>Group {{.ID}}</h2>
+<div class="scenes">
+{{range .Scenes}}{{template "scene" .}}{{end}}
+</div>
+<table class="matches">
+<tr><th>Subject</th><th>Other</th><th>Score</th><th>Ratio diff</th><th>dHash distance</th><th>Histogram distance</th><th>Notes</th></tr>
+{{range .Matches}}
+<tr><td>{{.Subject}}</td><td>{{.Other}}</td><td>{{printf "%.f" .Score}}</td><td>{{printf "%.4f" .RatioDiff}}</td><td>{{.DHashDistance}}</td><td>{{.HistogramDistance}}</td><td>{{.Notes}}</td></tr>
+{{end}}
+</table>
+</div>
+{{end}}
+{{if .PartialMatches}}
+<div class="group" id="partial">
+<h2>Partial matches</h2>
+{{template "partial description"}}
+<table class="matches">
+<tr><th>Subject</th><th>Other</th><th>Score</th><th>Ratio diff</th><th>dHash distance</th><th>Histogram distance</th><th>Notes</th></tr>
+{{range .PartialMatches}}
+<tr><td>{{.Subject}}</td><td>{{.Other}}</td><td>{{printf "%.f" .Score}}</td><td>{{printf "%.4f" .RatioDiff}}</td><td>{{.DHashDistance}}</td><td>{{.HistogramDistance}}</td><td>{{.Notes}}</td></tr>
+{{end}}
+</table>
+</div>
+{{end}}
+</body>
+</html>
+`))
+
+type htmlReportScene struct {
+	Name       string
+	ID         string
+	URL        string
+	Path       string
+	Resolution string
+	Duration   string
+	Size       string
+	Image      template.URL
+}
+
+type htmlReportMatch struct {
+	Subject           string
+	Other             string
+	Score             float64
+	RatioDiff         float64
+	DHashDistance     int
+	HistogramDistance int
+	Notes             string
+}
+
+type htmlReportGroup struct {
+	ID      int
+	Scenes  []htmlReportScene
+	Matches []htmlReportMatch
+}
+
+func writeHTMLReport(w io.Writer, r report) error {
+	sorted, groups := sortedByGroup(r.results)
+
+	var htmlGroups []*htmlReportGroup
+	added := make(map[string]bool)
+	for _, m := range sorted {
+		id := groups[m.Subject]
+		if len(htmlGroups) < id {
+			htmlGroups = append(htmlGroups, &htmlReportGroup{ID: id})
+		}
+		g := htmlGroups[id-1]
+
+		for _, name := range []string{m.Subject, m.Other} {
+			if !added[name] {
+				added[name] = true
+				g.Scenes = append(g.Scenes, r.htmlScene(name))
+			}
+		}
+
+		g.Matches = append(g.Matches, htmlMatch(m, sceneLabel(g.Scenes, m.Subject), sceneLabel(g.Scenes, m.Other)))
+	}
+
+	// partial matches are listed separately, without sprite images
+	var partial []htmlReportMatch
+	for _, m := range sortedPartial(r.results) {
+		partial = append(partial, htmlMatch(m, r.label(m.Subject), r.label(m.Other)))
+	}
+
+	for _, g := range htmlGroups {
+		// ids are numeric, so sort shorter ids first
+		sort.SliceStable(g.Scenes, func(i, j int) bool {
+			a, b := g.Scenes[i].ID, g.Scenes[j].ID
+			if len(a) != len(b) {
+				return len(a) < len(b)
+			}
+			return a < b
+		})
+	}
+
+	return htmlReportTemplate.Execute(w, struct {
+		SpriteWidth    int
+		MatchCount     int
+		Groups         []*htmlReportGroup
+		PartialMatches []htmlReportMatch
+	}{
+		SpriteWidth:    htmlSpriteWidth,
+		MatchCount:     len(sorted),
+		Groups:         htmlGroups,
+		PartialMatches: partial,
+	})
+}
+
+func htmlMatch(m *matchResult, subject, other string) htmlReportMatch {
+	return htmlReportMatch{
+		Subject:           subject,
+		Other:             other,
+		Score:             -m.Score,
+		RatioDiff:         m.RatioDiff,
+		DHashDistance:     m.DHashDistance,
+		HistogramDistance: m.HistogramDistance,
+		Notes:             strings.TrimPrefix(m.notes(), ", "),
+	}
+}
+
+// sceneLabel returns the scene id for the sprite if known, otherwise the
+// sprite name.
+func sceneLabel(scenes []htmlReportScene, name string) string {
+	for _, s := range scenes {
+		if s.Name == name && s.ID != "" {
+			return s.ID
+		}
+	}
+
+	return name
+}
+
+// label returns the scene id of the sprite from the cache, or the sprite name
+// if the scene is not known.
+func (r report) label(name string) string {
+	if r.cache != nil {
+		if s, err := r.cache.get(name); err == nil {
+			return fmt.Sprint(s.ID)
+		}
+	}
+
+	return name
+}
+
+func (r report) htmlScene(name string) htmlReportScene {
+	ret := htmlReportScene{
+		Name: name,
+	}
+
+	if r.spriteDir != "" {
+		img, err := spriteThumbnail(getSpriteFilename(r.spriteDir, name))
+		if err == nil {
+			ret.Image = img
+		}
+	}
+
+	if r.cache == nil {
+		return ret
+	}
+
+	s, err := r.cache.get(name)
+	if err != nil {
+		return ret
+	}
+
+	ret.ID = fmt.Sprint(s.ID)
+	ret.Path = string(s.Path)
+	ret.Resolution = s.File.resolutionString()
+	if s.File.Duration != nil {
+		ret.Duration = formatDuration(float64(*s.File.Duration))
+	}
+	if s.File.Size != nil {
+		ret.Size = formatSize(string(*s.File.Size))
+	}
+	if r.serverURL != "" {
+		ret.URL = sceneURL(r.serverURL, ret.ID)
+	}
+
+	return ret
+}
+
+// spriteThumbnail returns a downscaled copy of the sprite as a jpeg data URI.
+func spriteThumbnail(fn string) (template.URL, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	img, err := jpeg.Decode(f)
+	if err != nil {
+		return "", err
+	}
+
+	scaled := resize.Resize(htmlSpriteWidth, 0, img, resize.Bilinear)
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, scaled, &jpeg.Options{Quality: 75}); err != nil {
+		return "", err
+	}
+
+	return template.URL("data:image/jpeg;base64," + base64.StdEncoding.EncodeToString(buf.Bytes())), nil
+}
+
+// formatDuration formats seconds as [h:]mm:ss.
+func formatDuration(seconds float64) string {
+	s := int(seconds + 0.5)
+	if s >= 3600 {
+		return fmt.Sprintf("%d:%02d:%02d", s/3600, (s/60)%60, s%60)
+	}
+
+	return fmt.Sprintf("%d:%02d", s/60, s%60)
+}
+
+// formatSize formats a size in bytes using binary units.
+func formatSize(size string) string {
+	v, err := strconv.ParseFloat(size, 64)
+	if err != nil {
+		return size
+	}
+
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+	i := 0
+	for v >= 1024 && i < len(units)-1 {
+		v /= 1024
+		i++
+	}
+
+	return fmt.Sprintf("%.1f %s", v, units[i])
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+)
+
+// jsonReportVersion is the version of the JSON and JSON Lines report schema.
+// It must be incremented when fields are changed or removed.
+const jsonReportVersion = 2
+
+type jsonReportScene struct {
+	Sprite     string   `json:"sprite"`
+	ID         string   `json:"id,omitempty"`
+	Path       string   `json:"path,omitempty"`
+	Duration   *float64 `json:"duration,omitempty"`
+	Width      *int     `json:"width,omitempty"`
+	Height     *int     `json:"height,omitempty"`
+	Size       *int64   `json:"size,omitempty"`
+	Keep       bool     `json:"keep"`
+	URL        string   `json:"url,omitempty"`
+	SpritePath string   `json:"sprite_path,omitempty"`
+}
+
+type jsonReportMatch struct {
+	Group              int            `json:"group"`
+	Subject            string         `json:"subject"`
+	Other              string         `json:"other"`
+	Score              float64        `json:"score"`
+	RatioDiff          float64        `json:"ratio_diff"`
+	DHashDistance      int            `json:"dhash_distance"`
+	HistogramDistance  int            `json:"histogram_distance"`
+	Mirrored           bool           `json:"mirrored"`
+	SubjectAspectRatio float64        `json:"subject_aspect_ratio,omitempty"`
+	OtherAspectRatio   float64        `json:"other_aspect_ratio,omitempty"`
+	AspectRatioChanged bool           `json:"aspect_ratio_changed"`
+	Segments           []matchSegment `json:"segments,omitempty"`
+	Partial            bool           `json:"partial,omitempty"`
+	DurationScore      float64        `json:"duration_score,omitempty"`
+	Decision           string         `json:"decision,omitempty"`
+	Keep               string         `json:"keep,omitempty"`
+}
+
+type jsonReportGroup struct {
+	ID     int                `json:"id"`
+	Scenes []*jsonReportScene `json:"scenes"`
+}
+
+// jsonReportPartialMatch is a partial match, which is not part of a group,
+// so includes the details of its scenes.
+type jsonReportPartialMatch struct {
+	*jsonReportMatch
+	SubjectScene *jsonReportScene `json:"subject_scene"`
+	OtherScene   *jsonReportScene `json:"other_scene"`
+}
+
+type jsonReport struct {
+	Version        int                       `json:"version"`
+	Generated      string                    `json:"generated"`
+	Groups         []*jsonReportGroup        `json:"groups"`
+	Matches        []*jsonReportMatch        `json:"matches"`
+	PartialMatches []*jsonReportPartialMatch `json:"partial_matches"`
+}
+
+// jsonLinesReportMatch is a single line of the JSON Lines report.
+type jsonLinesReportMatch struct {
+	Version int `json:"version"`
+	*jsonReportMatch
+	SubjectScene *jsonReportScene `json:"subject_scene"`
+	OtherScene   *jsonReportScene `json:"other_scene"`
+}
+
+func (r report) jsonReport() *jsonReport {
+	sorted, groups := sortedByGroup(r.results)
+
+	ret := &jsonReport{
+		Version:        jsonReportVersion,
+		Generated:      time.Now().Format(time.RFC3339),
+		Groups:         []*jsonReportGroup{},
+		Matches:        []*jsonReportMatch{},
+		PartialMatches: []*jsonReportPartialMatch{},
+	}
+
+	added := make(map[string]bool)
+	for _, m := range sorted {
+		id := groups[m.Subject]
+		if len(ret.Groups) < id {
+			ret.Groups = append(ret.Groups, &jsonReportGroup{ID: id})
+		}
+		g := ret.Groups[id-1]
+
+		for _, name := range []string{m.Subject, m.Other} {
+			if !added[name] {
+				added[name] = true
+				g.Scenes = append(g.Scenes, r.jsonScene(name))
+			}
+		}
+
+		ret.Matches = append(ret.Matches, r.jsonMatch(m, id))
+	}
+
+	for _, m := range sortedPartial(r.results) {
+		ret.PartialMatches = append(ret.PartialMatches, &jsonReportPartialMatch{
+			jsonReportMatch: r.jsonMatch(m, 0),
+			SubjectScene:    r.jsonScene(m.Subject),
+			OtherScene:      r.jsonScene(m.Other),
+		})
+	}
+
+	return ret
+}
+
+// jsonMatch returns the report entry of the match. group is 0 for partial
+// matches.
+func (r report) jsonMatch(m *matchResult, group int) *jsonReportMatch {
+	ret := &jsonReportMatch{
+		Group:              group,
+		Subject:            m.Subject,
+		Other:              m.Other,
+		Score:              -m.Score,
+		RatioDiff:          m.RatioDiff,
+		DHashDistance:      m.DHashDistance,
+		HistogramDistance:  m.HistogramDistance,
+		Mirrored:           m.Mirrored,
+		SubjectAspectRatio: m.SubjectAspectRatio,
+		OtherAspectRatio:   m.OtherAspectRatio,
+		AspectRatioChanged: m.aspectRatioChanged(),
+		Segments:           m.Segments,
+		Partial:            m.Partial,
+		DurationScore:      -m.DurationScore,
+	}
+
+	if pd := r.decisions.get(m.Subject, m.Other); pd != nil {
+		ret.Decision = pd.Decision
+		ret.Keep = pd.Keep
+	}
+
+	return ret
+}
+
+func (r report) jsonScene(name string) *jsonReportScene {
+	ret := &jsonReportScene{
+		Sprite: name,
+		Keep:   r.decisions.isKeeper(name),
+	}
+
+	if r.spriteDir != "" {
+		ret.SpritePath = getSpriteFilename(r.spriteDir, name)
+	}
+
+	if r.cache == nil {
+		return ret
+	}
+
+	s, err := r.cache.get(name)
+	if err != nil {
+		return ret
+	}
+
+	ret.ID = fmt.Sprint(s.ID)
+	ret.Path = string(s.Path)
+	if s.File.Duration != nil {
+		v := float64(*s.File.Duration)
+		ret.Duration = &v
+	}
+	if s.File.Width != nil && s.File.Height != nil {
+		w := int(*s.File.Width)
+		h := int(*s.File.Height)
+		ret.Width = &w
+		ret.Height = &h
+	}
+	if s.File.Size != nil {
+		if v, err := strconv.ParseInt(string(*s.File.Size), 10, 64); err == nil {
+			ret.Size = &v
+		}
+	}
+	if r.serverURL != "" {
+		ret.URL = sceneURL(r.serverURL, ret.ID)
+	}
+
+	return ret
+}
+
+func writeJSONReport(w io.Writer, r report) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r.jsonReport())
+}
+
+func writeJSONLinesReport(w io.Writer, r report) error {
+	jr := r.jsonReport()
+
+	scenes := make(map[string]*jsonReportScene)
+	for _, g := range jr.Groups {
+		for _, s := range g.Scenes {
+			scenes[s.Sprite] = s
+		}
+	}
+
+	enc := json.NewEncoder(w)
+	for _, m := range jr.Matches {
+		line := jsonLinesReportMatch{
+			Version:         jsonReportVersion,
+			jsonReportMatch: m,
+			SubjectScene:    scenes[m.Subject],
+			OtherScene:      scenes[m.Other],
+		}
+
+		if err := enc.Encode(line); err != nil {
+			return err
+		}
+	}
+
+	for _, m := range jr.PartialMatches {
+		line := jsonLinesReportMatch{
+			Version:         jsonReportVersion,
+			jsonReportMatch: m.jsonReportMatch,
+			SubjectScene:    m.SubjectScene,
+			OtherScene:      m.OtherScene,
+		}
+
+		if err := enc.Encode(line); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
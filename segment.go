@@ -0,0 +1,284 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"os"
+	"strings"
+
+	"stash-plugin-duplicate-finder/internal/plugin/common/log"
+
+	"github.com/rivo/duplo"
+)
+
+// segmentHashDistance is the maximum hamming distance between the hashes of
+// two tiles for them to show the same part of a video.
+const segmentHashDistance = 10
+
+// maxSegmentGap is the maximum number of unmatched tiles between the matched
+// tiles of a segment.
+const maxSegmentGap = 2
+
+// minSegmentTiles is the minimum number of matched tiles in a segment.
+const minSegmentTiles = 2
+
+// matchSegment is a part of the subject scene that matches a part of the
+// other scene. Times are in seconds.
+type matchSegment struct {
+	SubjectStart float64 `json:"subject_start"`
+	SubjectEnd   float64 `json:"subject_end"`
+	OtherStart   float64 `json:"other_start"`
+	OtherEnd     float64 `json:"other_end"`
+}
+
+// swap returns the segment with the subject and other scenes swapped.
+func (s matchSegment) swap() matchSegment {
+	return matchSegment{
+		SubjectStart: s.OtherStart,
+		SubjectEnd:   s.OtherEnd,
+		OtherStart:   s.SubjectStart,
+		OtherEnd:     s.SubjectEnd,
+	}
+}
+
+func (s matchSegment) String() string {
+	return fmt.Sprintf("%s-%s = %s-%s", formatTimestamp(s.SubjectStart), formatTimestamp(s.SubjectEnd), formatTimestamp(s.OtherStart), formatTimestamp(s.OtherEnd))
+}
+
+// formatSegments returns the segments as a string, separated by semicolons.
+func formatSegments(segments []matchSegment) string {
+	var ret []string
+	for _, s := range segments {
+		ret = append(ret, s.String())
+	}
+
+	return strings.Join(ret, "; ")
+}
+
+// formatTimestamp returns the time in the form hh:mm:ss.
+func formatTimestamp(seconds float64) string {
+	s := int(seconds + 0.5)
+	return fmt.Sprintf("%02d:%02d:%02d", s/3600, s/60%60, s%60)
+}
+
+// tileSegment is a sequence of tiles of the subject sprite that match a
+// sequence of tiles of the other sprite. Indexes are inclusive.
+type tileSegment struct {
+	subjectStart, subjectEnd int
+	otherStart, otherEnd     int
+	tiles                    int
+}
+
+// alignTiles returns the sequences of tiles that match between the sprites.
+// Tiles with a hash of 0, which have no detail, are not matched. Copies
+// with a different duration have differently spaced tiles, so each tile of
+// the subject is matched to the most similar tile of the other sprite, and
+// consecutive matches that progress through both sprites form a segment.
+// Matches that do not continue a segment start a new one, so that a single
+// wrongly matched tile does not split a segment.
+func alignTiles(hashes, otherHashes []uint64) []tileSegment {
+	var segments []*tileSegment
+	lastOther := -1
+
+	for i, h := range hashes {
+		if h == 0 {
+			continue
+		}
+
+		best := -1
+		bestDistance := segmentHashDistance + 1
+		for j, oh := range otherHashes {
+			if oh == 0 {
+				continue
+			}
+
+			// when equally similar, tiles after the previous match are
+			// preferred to tiles before it
+			d := hammingDistance(h, oh)
+			if d < bestDistance || (d == bestDistance && best < lastOther && j >= lastOther) {
+				best = j
+				bestDistance = d
+			}
+		}
+
+		if best < 0 {
+			continue
+		}
+
+		var current *tileSegment
+		for _, s := range segments {
+			if i-s.subjectEnd <= maxSegmentGap+1 && best >= s.otherEnd && best-s.otherEnd <= maxSegmentGap+1 && (current == nil || s.tiles > current.tiles) {
+				current = s
+			}
+		}
+
+		if current != nil {
+			current.subjectEnd = i
+			current.otherEnd = best
+			current.tiles++
+			lastOther = best
+		} else {
+			segments = append(segments, &tileSegment{
+				subjectStart: i,
+				subjectEnd:   i,
+				otherStart:   best,
+				otherEnd:     best,
+				tiles:        1,
+			})
+		}
+	}
+
+	var ret []tileSegment
+	for _, s := range segments {
+		if s.tiles >= minSegmentTiles {
+			ret = append(ret, *s)
+		}
+	}
+
+	return ret
+}
+
+// timeSegments converts the tile segments to time ranges using the VTT cues
+// of each sprite. Segments with tiles without cues are omitted.
+func timeSegments(segments []tileSegment, vtt, otherVTT spriteVTT) []matchSegment {
+	cue := func(v spriteVTT, i int) *vttCue {
+		if i < len(v) {
+			return v[i]
+		}
+		return nil
+	}
+
+	var ret []matchSegment
+	for _, s := range segments {
+		subjectStart, subjectEnd := cue(vtt, s.subjectStart), cue(vtt, s.subjectEnd)
+		otherStart, otherEnd := cue(otherVTT, s.otherStart), cue(otherVTT, s.otherEnd)
+		if subjectStart == nil || subjectEnd == nil || otherStart == nil || otherEnd == nil {
+			continue
+		}
+
+		ret = append(ret, matchSegment{
+			SubjectStart: subjectStart.start,
+			SubjectEnd:   subjectEnd.end,
+			OtherStart:   otherStart.start,
+			OtherEnd:     otherEnd.end,
+		})
+	}
+
+	return ret
+}
+
+// spriteTileHashes returns the hash of each tile of the sprite image, in row
+// order. Tiles without enough detail have a hash of 0.
+func spriteTileHashes(img image.Image) []uint64 {
+	var ret []uint64
+	for _, t := range spriteTiles(img, spriteGridSize, spriteGridSize) {
+		var h uint64
+		if isInformative(t) {
+			h = tileHash(t)
+		}
+		ret = append(ret, h)
+	}
+
+	return ret
+}
+
+// tileHashes returns the tile hashes of the sprite from its metadata,
+// hashing the sprite file if they are not known.
+func (a *api) tileHashes(path, name string) ([]uint64, error) {
+	if m := a.meta[name]; m != nil && len(m.TileHashes) > 0 {
+		return m.tileHashes(), nil
+	}
+
+	o := a.hashOptions(name)
+	o.tileHashes = true
+	hashes, err := getImageHashes(getSpriteFilename(path, name), o)
+	if err != nil {
+		return nil, err
+	}
+
+	a.setMeta(name, hashes)
+	return hashes.tileHashes, nil
+}
+
+// needsTileHashes returns true if the tile hashes of the sprite in path are
+// computed when it is hashed: if its VTT file exists, or if marker_tag_name,
+// exclude_intros or max_duration_diff is set. Otherwise tileHashes computes
+// them if they are needed later.
+func (a *api) needsTileHashes(path, name string) bool {
+	if a.cfg.MarkerTagName != "" || a.cfg.ExcludeIntros || a.cfg.MaxDurationDiff > 0 {
+		return true
+	}
+
+	_, err := os.Stat(getVTTFilename(path, name))
+	return err == nil
+}
+
+// setMeta replaces the metadata of the sprite with the metadata detected
+// when hashing it, including its tile hashes if they were computed. The known
+// scene duration is kept.
+func (a *api) setMeta(name string, hashes *spriteHashes) *spriteMeta {
+	m := hashes.meta
+	if m == nil {
+		m = &spriteMeta{}
+	}
+
+	if existing := a.meta[name]; existing != nil {
+		m.Duration = existing.Duration
+	}
+
+	m.TileHashes = nil
+	for _, h := range hashes.tileHashes {
+		m.TileHashes = append(m.TileHashes, hexHash(h))
+	}
+
+	a.meta[name] = m
+	return m
+}
+
+// alignMatches finds the matching segments of the subject and each of the
+// matches, using the VTT files of the sprites to convert tiles to times. The
+// segments are stored for both orientations of each pair.
+func (a *api) alignMatches(path, checksum string, hashes *spriteHashes, matches duplo.Matches) {
+	if len(matches) == 0 {
+		return
+	}
+
+	vtt, err := readVTT(getVTTFilename(path, checksum))
+	if err != nil {
+		log.Debugf("Not aligning matches of %s: %s", checksum, err.Error())
+		return
+	}
+
+	if a.segments == nil {
+		a.segments = make(map[string][]matchSegment)
+	}
+
+	for _, m := range matches {
+		other := m.ID.(string)
+		otherVTT, err := readVTT(getVTTFilename(path, other))
+		if err != nil {
+			log.Debugf("Not aligning %s with %s: %s", checksum, other, err.Error())
+			continue
+		}
+
+		otherHashes, err := a.tileHashes(path, other)
+		if err != nil {
+			log.Debugf("Not aligning %s with %s: %s", checksum, other, err.Error())
+			continue
+		}
+
+		subjectHashes := hashes.tileHashes
+		if a.mirrored[pairKey(checksum, other)] && hashes.mirroredTileHashes != nil {
+			subjectHashes = hashes.mirroredTileHashes
+		}
+
+		segments := timeSegments(alignTiles(subjectHashes, otherHashes), vtt, otherVTT)
+		a.segments[checksum+"|"+other] = segments
+
+		var swapped []matchSegment
+		for _, s := range segments {
+			swapped = append(swapped, s.swap())
+		}
+		a.segments[other+"|"+checksum] = swapped
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// testTileHash returns a distinct tile hash for n, far from the hashes of
+// other values of n.
+func testTileHash(n int) uint64 {
+	// splitmix64
+	z := uint64(n+1) * 0x9e3779b97f4a7c15
+	z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+	z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+	return z ^ (z >> 31)
+}
+
+// testTileHashes returns the tile hashes for the values. Negative values are
+// tiles without detail, with a hash of 0.
+func testTileHashes(values ...int) []uint64 {
+	var ret []uint64
+	for _, v := range values {
+		if v < 0 {
+			ret = append(ret, 0)
+		} else {
+			ret = append(ret, testTileHash(v))
+		}
+	}
+
+	return ret
+}
+
+func seq(start, end int) []int {
+	var ret []int
+	for i := start; i <= end; i++ {
+		ret = append(ret, i)
+	}
+
+	return ret
+}
+
+func TestAlignTiles(t *testing.T) {
+	// a hash of tile 5 with a few bits changed, such as by re-encoding
+	similar := testTileHash(5) ^ 0x8000000100000001
+
+	tests := []struct {
+		name   string
+		hashes []uint64
+		other  []uint64
+		want   []tileSegment
+	}{
+		{
+			name:   "identical",
+			hashes: testTileHashes(seq(0, 80)...),
+			other:  testTileHashes(seq(0, 80)...),
+			want:   []tileSegment{{0, 80, 0, 80, 81}},
+		},
+		{
+			name:   "other trimmed at the start",
+			hashes: testTileHashes(seq(0, 9)...),
+			other:  testTileHashes(seq(3, 9)...),
+			want:   []tileSegment{{3, 9, 0, 6, 7}},
+		},
+		{
+			name:   "other extended at both ends",
+			hashes: testTileHashes(seq(0, 5)...),
+			other:  testTileHashes(append(append([]int{50, 51}, seq(0, 5)...), 52, 53)...),
+			want:   []tileSegment{{0, 5, 2, 7, 6}},
+		},
+		{
+			name:   "other twice as long",
+			hashes: testTileHashes(0, 1, 2, 3, 4, 5),
+			other:  testTileHashes(0, 0, 1, 1, 2, 2, 3, 3, 4, 4, 5, 5),
+			want:   []tileSegment{{0, 5, 0, 10, 6}},
+		},
+		{
+			name:   "other half as long",
+			hashes: testTileHashes(0, 0, 1, 1, 2, 2, 3, 3),
+			other:  testTileHashes(0, 1, 2, 3),
+			want:   []tileSegment{{0, 7, 0, 3, 8}},
+		},
+		{
+			name:   "similar tile",
+			hashes: append(testTileHashes(3, 4), similar),
+			other:  testTileHashes(3, 4, 5),
+			want:   []tileSegment{{0, 2, 0, 2, 3}},
+		},
+		{
+			name:   "gap within the limit",
+			hashes: testTileHashes(0, 1, 2, 60, 61, 5, 6),
+			other:  testTileHashes(0, 1, 2, 3, 4, 5, 6),
+			want:   []tileSegment{{0, 6, 0, 6, 5}},
+		},
+		{
+			name:   "gap too long",
+			hashes: testTileHashes(0, 1, 2, 60, 61, 62, 6, 7),
+			other:  testTileHashes(0, 1, 2, 3, 4, 5, 6, 7),
+			want:   []tileSegment{{0, 2, 0, 2, 3}, {6, 7, 6, 7, 2}},
+		},
+		{
+			name:   "tiles without detail",
+			hashes: testTileHashes(-1, -1, 0, 1, -1, 2, -1),
+			other:  testTileHashes(-1, 0, 1, 2, -1, -1, -1),
+			want:   []tileSegment{{2, 5, 1, 3, 3}},
+		},
+		{
+			name:   "no detail",
+			hashes: testTileHashes(-1, -1, -1),
+			other:  testTileHashes(-1, -1, -1),
+		},
+		{
+			name:   "single matching tile",
+			hashes: testTileHashes(0, 1, 2),
+			other:  testTileHashes(50, 1, 51),
+		},
+		{
+			name:   "no match",
+			hashes: testTileHashes(0, 1, 2),
+			other:  testTileHashes(50, 51, 52),
+		},
+		{
+			name:   "halves swapped",
+			hashes: testTileHashes(seq(0, 7)...),
+			other:  testTileHashes(append(seq(4, 7), seq(0, 3)...)...),
+			want:   []tileSegment{{0, 3, 4, 7, 4}, {4, 7, 0, 3, 4}},
+		},
+		{
+			name:   "wrong match within a segment",
+			hashes: testTileHashes(0, 1, 2, 3, 4, 5),
+			other:  testTileHashes(0, 1, 2, 3, 4, 5, 2),
+			want:   []tileSegment{{0, 5, 0, 5, 6}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := alignTiles(tt.hashes, tt.other)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("alignTiles() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTimeSegments(t *testing.T) {
+	vtt := spriteVTT{{0, 20}, {20, 40}, {40, 60}, nil}
+	otherVTT := spriteVTT{{0, 10}, {10, 20}, {20, 30}, {30, 40}}
+
+	tests := []struct {
+		name     string
+		segments []tileSegment
+		want     []matchSegment
+	}{
+		{
+			name:     "whole tiles",
+			segments: []tileSegment{{0, 2, 1, 3, 3}},
+			want:     []matchSegment{{0, 60, 10, 40}},
+		},
+		{
+			name:     "tile without a cue",
+			segments: []tileSegment{{2, 3, 0, 1, 2}, {0, 1, 2, 3, 2}},
+			want:     []matchSegment{{0, 40, 20, 40}},
+		},
+		{
+			name:     "tile outside the cues",
+			segments: []tileSegment{{0, 1, 3, 4, 2}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := timeSegments(tt.segments, vtt, otherVTT)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("timeSegments() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
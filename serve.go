@@ -0,0 +1,302 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"stash-plugin-duplicate-finder/internal/plugin/common/log"
+)
+
+var reviewTemplate = template.Must(template.New("review").Parse(htmlTemplatePartials + `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Duplicate finder review</title>
+<style>
+{{template "style" .}}
+.matches td { vertical-align: middle; }
+.decided { color: #a7b6c2; }
+form { display: inline; }
+</style>
+</head>
+<body>
+<h1>Duplicate finder review</h1>
+<p>{{.GroupCount}} groups, {{.MatchCount}} matches{{if .PartialCount}}, {{.PartialCount}} partial matches{{end}}, {{.Undecided}} undecided.
+{{if .UndecidedOnly}}<a href="/">Show all</a>{{else}}<a href="/?undecided=1">Show undecided only</a>{{end}}</p>
+{{range .Groups}}
+<div class="group" id="{{.Anchor}}">
+{{if .ID}}<h2>Group {{.ID}}</h2>{{else}}<h2>Partial matches</h2>
+{{template "partial description"}}{{end}}
+<div class="scenes">
+{{range .Scenes}}{{template "scene" .}}{{end}}
+</div>
+<table class="matches">
+<tr><th>Subject</th><th>Other</th><th>Score</th><th>Decision</th><th></th></tr>
+{{$group := .ID}}
+{{range .Matches}}
+<tr{{if .Decision}} class="decided"{{end}}>
+<td>{{.SubjectLabel}}</td><td>{{.OtherLabel}}</td><td>{{printf "%.f" .Score}}{{if .Notes}} ({{.Notes}}){{end}}</td><td>{{.Decision}}</td>
+<td>
+<form method="post" action="/decide">
+<input type="hidden" name="token" value="{{$.Token}}">
+<input type="hidden" name="subject" value="{{.Subject}}">
+<input type="hidden" name="other" value="{{.Other}}">
+<input type="hidden" name="group" value="{{$group}}">
+{{if $.UndecidedOnly}}<input type="hidden" name="undecided" value="1">{{end}}
+<button name="decision" value="duplicate">Duplicate</button>
+<button name="decision" value="not_duplicate">Not duplicate</button>
+<button name="keep" value="{{.Subject}}">Keep {{.SubjectLabel}}</button>
+<button name="keep" value="{{.Other}}">Keep {{.OtherLabel}}</button>
+{{if .Decision}}<button name="decision" value="">Clear</button>{{end}}
+</form>
+</td>
+</tr>
+{{end}}
+</table>
+</div>
+{{end}}
+</body>
+</html>
+`))
+
+type reviewMatch struct {
+	Subject      string
+	Other        string
+	SubjectLabel string
+	OtherLabel   string
+	Score        float64
+	Notes        string
+	Decision     string
+}
+
+// reviewGroup is a group of duplicates, or the partial matches if ID is 0.
+type reviewGroup struct {
+	ID      int
+	Scenes  []htmlReportScene
+	Matches []reviewMatch
+}
+
+// Anchor returns the id of the group element on the review page.
+func (g *reviewGroup) Anchor() string {
+	return groupAnchor(g.ID)
+}
+
+func groupAnchor(id int) string {
+	if id == 0 {
+		return "partial"
+	}
+
+	return fmt.Sprintf("group-%d", id)
+}
+
+// reviewServer serves a web page to review the matches, and records the
+// decisions made. Sprite images are served from spriteDir rather than being
+// embedded by the report.
+type reviewServer struct {
+	report        report
+	spriteDir     string
+	decisionsFile string
+
+	// token is included in the decision forms, so that other sites cannot
+	// post decisions
+	token string
+
+	// pairs contains the keys of the pairs in the results
+	pairs map[string]bool
+
+	mutex     sync.Mutex
+	decisions decisions
+}
+
+func (s *reviewServer) serve(addr string) error {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+	s.token = hex.EncodeToString(b)
+
+	s.pairs = make(map[string]bool)
+	for _, m := range s.report.results {
+		s.pairs[pairKey(m.Subject, m.Other)] = true
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", s.handleIndex)
+	mux.HandleFunc("/decide", s.handleDecide)
+	mux.HandleFunc("/sprite/", s.handleSprite)
+
+	log.Infof("Serving review page at http://%s/", addr)
+	return http.ListenAndServe(addr, mux)
+}
+
+func (s *reviewServer) handleIndex(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	undecidedOnly := r.URL.Query().Get("undecided") != ""
+	sorted, groups := sortedByGroup(s.report.results)
+	partial := sortedPartial(s.report.results)
+
+	var reviewGroups []*reviewGroup
+	byID := make(map[int]*reviewGroup)
+	added := make(map[string]bool)
+	undecided := 0
+
+	// partial matches are reviewed in a group of their own, after the groups
+	// of duplicates
+	for _, m := range append(sorted, partial...) {
+		pd := s.decisions.get(m.Subject, m.Other)
+		if pd == nil {
+			undecided++
+		} else if undecidedOnly {
+			continue
+		}
+
+		id := 0
+		if !m.Partial {
+			id = groups[m.Subject]
+		}
+		g := byID[id]
+		if g == nil {
+			g = &reviewGroup{ID: id}
+			byID[id] = g
+			reviewGroups = append(reviewGroups, g)
+		}
+
+		for _, name := range []string{m.Subject, m.Other} {
+			key := fmt.Sprintf("%d|%s", id, name)
+			if !added[key] {
+				added[key] = true
+				scene := s.report.htmlScene(name)
+				scene.Image = template.URL("/sprite/" + name)
+				g.Scenes = append(g.Scenes, scene)
+			}
+		}
+
+		decision := ""
+		if pd != nil {
+			decision = pd.Decision
+			if pd.Keep != "" {
+				decision = "keep " + sceneLabel(g.Scenes, pd.Keep)
+			}
+		}
+
+		g.Matches = append(g.Matches, reviewMatch{
+			Subject:      m.Subject,
+			Other:        m.Other,
+			SubjectLabel: sceneLabel(g.Scenes, m.Subject),
+			OtherLabel:   sceneLabel(g.Scenes, m.Other),
+			Score:        -m.Score,
+			Notes:        strings.TrimPrefix(m.notes(), ", "),
+			Decision:     decision,
+		})
+	}
+
+	groupCount := len(reviewGroups)
+	if byID[0] != nil {
+		groupCount--
+	}
+
+	err := reviewTemplate.Execute(w, struct {
+		SpriteWidth   int
+		GroupCount    int
+		MatchCount    int
+		PartialCount  int
+		Undecided     int
+		UndecidedOnly bool
+		Token         string
+		Groups        []*reviewGroup
+	}{
+		SpriteWidth:   htmlSpriteWidth,
+		GroupCount:    groupCount,
+		MatchCount:    len(sorted),
+		PartialCount:  len(partial),
+		Undecided:     undecided,
+		UndecidedOnly: undecidedOnly,
+		Token:         s.token,
+		Groups:        reviewGroups,
+	})
+	if err != nil {
+		log.Errorf("Error rendering review page: %s", err.Error())
+	}
+}
+
+func (s *reviewServer) handleDecide(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if subtle.ConstantTimeCompare([]byte(r.FormValue("token")), []byte(s.token)) != 1 {
+		http.Error(w, "invalid token", http.StatusForbidden)
+		return
+	}
+
+	subject := r.FormValue("subject")
+	other := r.FormValue("other")
+	decision := r.FormValue("decision")
+	keep := r.FormValue("keep")
+
+	if !s.pairs[pairKey(subject, other)] {
+		http.Error(w, "unknown pair", http.StatusBadRequest)
+		return
+	}
+
+	if keep != "" {
+		if keep != subject && keep != other {
+			http.Error(w, "invalid keep value", http.StatusBadRequest)
+			return
+		}
+		decision = decisionDuplicate
+	}
+
+	switch decision {
+	case "", decisionDuplicate, decisionNotDuplicate:
+	default:
+		http.Error(w, "invalid decision", http.StatusBadRequest)
+		return
+	}
+
+	s.mutex.Lock()
+	s.decisions.set(subject, other, decision, keep)
+	err := storeDecisions(s.decisions, s.decisionsFile)
+	s.mutex.Unlock()
+
+	if err != nil {
+		http.Error(w, fmt.Sprintf("error writing decisions file: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+
+	redirect := "/"
+	if r.FormValue("undecided") != "" {
+		redirect = "/?undecided=1"
+	}
+	if group, err := strconv.Atoi(r.FormValue("group")); err == nil {
+		redirect += "#" + groupAnchor(group)
+	}
+	http.Redirect(w, r, redirect, http.StatusSeeOther)
+}
+
+func (s *reviewServer) handleSprite(w http.ResponseWriter, r *http.Request) {
+	// only serve sprite files from the sprite directory
+	name := filepath.Base(r.URL.Path)
+	if s.spriteDir == "" || name != r.URL.Path[len("/sprite/"):] {
+		http.NotFound(w, r)
+		return
+	}
+
+	http.ServeFile(w, r, getSpriteFilename(s.spriteDir, name))
+}
@@ -0,0 +1,425 @@
+package main
+
+import (
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"math"
+	"math/bits"
+	"os"
+
+	"github.com/nfnt/resize"
+)
+
+// spriteGridSize is the number of columns and rows of tiles in the sprite
+// files generated by stash.
+const spriteGridSize = 9
+
+type subImager interface {
+	SubImage(r image.Rectangle) image.Image
+}
+
+func readSprite(fn string) (image.Image, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return jpeg.Decode(f)
+}
+
+// spriteTiles splits the sprite image into a grid of tiles, in row order.
+func spriteTiles(img image.Image, cols, rows int) []image.Image {
+	bounds := img.Bounds()
+	w := bounds.Dx() / cols
+	h := bounds.Dy() / rows
+
+	si, ok := img.(subImager)
+	if !ok || w == 0 || h == 0 {
+		return nil
+	}
+
+	var ret []image.Image
+	for y := 0; y < rows; y++ {
+		for x := 0; x < cols; x++ {
+			min := bounds.Min.Add(image.Pt(x*w, y*h))
+			ret = append(ret, si.SubImage(image.Rectangle{Min: min, Max: min.Add(image.Pt(w, h))}))
+		}
+	}
+
+	return ret
+}
+
+// borderTolerance is the maximum standard deviation of the luminance of a
+// line of pixels for it to be part of a uniform border. It is also the
+// maximum difference between the mean luminance of the line and the outermost
+// line of the border.
+const borderTolerance = 0.04 * 65535
+
+// maxBorderFraction is the maximum fraction of the width or height of a tile
+// that is removed from each side as a border.
+const maxBorderFraction = 0.4
+
+// spriteHashOptions are the options used to prepare sprites for hashing.
+type spriteHashOptions struct {
+	mirrored    bool
+	cropBorders bool
+
+	// masks are the regions of each tile excluded from hashing
+	masks []maskRect
+
+	// autoMask excludes regions that are static throughout the sprite
+	autoMask bool
+
+	// skipUninformative excludes tiles without enough detail, such as black
+	// frames and fades. Sprites with fewer than minInformativeTiles
+	// informative tiles are flagged as low information.
+	skipUninformative   bool
+	minInformativeTiles int
+
+	// intros are the known intros and outros excluded from hashing
+	intros []knownIntro
+
+	// tileHashes computes the hash of each tile, used to align matches
+	tileHashes bool
+}
+
+// contentRect is a rectangle within the tiles of a sprite, relative to the
+// tile origin.
+type contentRect struct {
+	X      int `json:"x"`
+	Y      int `json:"y"`
+	Width  int `json:"width"`
+	Height int `json:"height"`
+}
+
+func newContentRect(r image.Rectangle) contentRect {
+	return contentRect{
+		X:      r.Min.X,
+		Y:      r.Min.Y,
+		Width:  r.Dx(),
+		Height: r.Dy(),
+	}
+}
+
+// spriteMeta contains the details detected when hashing a sprite.
+type spriteMeta struct {
+	TileWidth  int `json:"tile_width"`
+	TileHeight int `json:"tile_height"`
+
+	// Content is the area of the tiles within any uniform borders. It is
+	// nil if borders were not detected.
+	Content *contentRect `json:"content,omitempty"`
+
+	// StaticRegions are the regions of the tiles detected as static, after
+	// removing any borders
+	StaticRegions []contentRect `json:"static_regions,omitempty"`
+
+	// UninformativeTiles are the indexes of the tiles without enough detail
+	// to be used for matching
+	UninformativeTiles []int `json:"uninformative_tiles,omitempty"`
+
+	// LowInformation is true if the sprite has too few informative tiles to
+	// be matched
+	LowInformation bool `json:"low_information,omitempty"`
+
+	// IntroTiles are the indexes of the tiles that match a known intro or
+	// outro
+	IntroTiles []int `json:"intro_tiles,omitempty"`
+
+	// TileHashes are the hashes of the prepared tiles, used to find the
+	// matching segments of sprites
+	TileHashes []hexHash `json:"tile_hashes,omitempty"`
+
+	// Duration is the duration of the scene in seconds, from stash or the
+	// VTT file of the sprite. It is 0 if not known.
+	Duration float64 `json:"duration,omitempty"`
+}
+
+// aspectRatio returns the aspect ratio of the content of the tiles, or 0 if
+// not known.
+func (m spriteMeta) aspectRatio() float64 {
+	if m.Content == nil || m.Content.Height == 0 {
+		return 0
+	}
+
+	return float64(m.Content.Width) / float64(m.Content.Height)
+}
+
+func (m spriteMeta) tileHashes() []uint64 {
+	var ret []uint64
+	for _, h := range m.TileHashes {
+		ret = append(ret, uint64(h))
+	}
+
+	return ret
+}
+
+// informativeTiles returns the number of informative tiles of the sprite.
+func (m spriteMeta) informativeTiles() int {
+	return spriteGridSize*spriteGridSize - len(m.UninformativeTiles)
+}
+
+// spriteMetas contains the sprite metadata, keyed by sprite name.
+type spriteMetas map[string]*spriteMeta
+
+// prepareSprite applies the options to the sprite image before hashing. It
+// returns the prepared image, and the sprite metadata if any was detected.
+func prepareSprite(img image.Image, o spriteHashOptions) (image.Image, *spriteMeta) {
+	if !o.cropBorders && len(o.masks) == 0 && !o.autoMask && !o.skipUninformative && len(o.intros) == 0 {
+		return img, nil
+	}
+
+	tiles := spriteTiles(img, spriteGridSize, spriteGridSize)
+	if len(tiles) == 0 {
+		return img, nil
+	}
+
+	tb := tiles[0].Bounds()
+	meta := &spriteMeta{
+		TileWidth:  tb.Dx(),
+		TileHeight: tb.Dy(),
+	}
+
+	if o.cropBorders {
+		var content image.Rectangle
+		img, content = cropBorders(img, tiles)
+		r := newContentRect(content)
+		meta.Content = &r
+	}
+
+	// uninformative and intro tiles are detected before masking, so that
+	// masked regions do not affect the detection
+	tiles = spriteTiles(img, spriteGridSize, spriteGridSize)
+	if o.skipUninformative {
+		meta.UninformativeTiles = uninformativeTiles(tiles)
+		meta.LowInformation = meta.informativeTiles() < o.minInformativeTiles
+	}
+	meta.IntroTiles = introTiles(tiles, o.intros)
+
+	skip := make(map[int]bool)
+	for _, i := range meta.UninformativeTiles {
+		skip[i] = true
+	}
+	for _, i := range meta.IntroTiles {
+		skip[i] = true
+	}
+
+	var informative []image.Image
+	for i, t := range tiles {
+		if !skip[i] {
+			informative = append(informative, t)
+		}
+	}
+
+	if len(o.masks) > 0 || o.autoMask {
+		var regions []image.Rectangle
+		for _, m := range o.masks {
+			regions = append(regions, m.rect(tb.Dx(), tb.Dy()))
+		}
+
+		if o.autoMask {
+			static := staticRegions(informative)
+			for _, r := range static {
+				meta.StaticRegions = append(meta.StaticRegions, newContentRect(r))
+			}
+			regions = append(regions, static...)
+		}
+
+		if len(regions) > 0 {
+			img = applyMasks(img, spriteGridSize, spriteGridSize, regions)
+		}
+	}
+
+	// excluded tiles are filled with the mean colour of the sprite rather
+	// than a fixed colour, so that the sprites sharing an intro, or black and
+	// faded tiles in the same positions, do not become more similar
+	if len(skip) > 0 {
+		var excluded []int
+		for i := range tiles {
+			if skip[i] {
+				excluded = append(excluded, i)
+			}
+		}
+		img = fillTiles(img, spriteGridSize, spriteGridSize, excluded, meanColour(informative))
+	}
+
+	return img, meta
+}
+
+// cropBorders removes any uniform borders from the tiles of the sprite,
+// scaling the content of each tile to the full tile size. It returns the
+// cropped sprite and the content area of the tiles.
+func cropBorders(img image.Image, tiles []image.Image) (image.Image, image.Rectangle) {
+	// letterboxing is constant throughout a video, while dark frames appear
+	// to have large borders, so the smallest border of each side is used
+	tb := tiles[0].Bounds()
+	left, top, right, bottom := tb.Dx(), tb.Dy(), tb.Dx(), tb.Dy()
+	for _, t := range tiles {
+		l, tp, r, b := tileBorders(t)
+		left = minInt(left, l)
+		top = minInt(top, tp)
+		right = minInt(right, r)
+		bottom = minInt(bottom, b)
+	}
+
+	content := image.Rect(left, top, tb.Dx()-right, tb.Dy()-bottom)
+	if left+top+right+bottom == 0 {
+		return img, content
+	}
+
+	ret := image.NewRGBA(image.Rect(0, 0, img.Bounds().Dx(), img.Bounds().Dy()))
+	for i, t := range tiles {
+		b := t.Bounds()
+		c := t.(subImager).SubImage(content.Add(b.Min))
+		scaled := resize.Resize(uint(b.Dx()), uint(b.Dy()), c, resize.Bilinear)
+
+		x := (i % spriteGridSize) * b.Dx()
+		y := (i / spriteGridSize) * b.Dy()
+		draw.Draw(ret, image.Rect(x, y, x+b.Dx(), y+b.Dy()), scaled, scaled.Bounds().Min, draw.Src)
+	}
+
+	return ret, content
+}
+
+// tileBorders returns the size of the uniform borders on the left, top,
+// right and bottom of the tile.
+func tileBorders(tile image.Image) (left, top, right, bottom int) {
+	b := tile.Bounds()
+	w, h := b.Dx(), b.Dy()
+
+	lum := make([][]float64, h)
+	for y := 0; y < h; y++ {
+		lum[y] = make([]float64, w)
+		for x := 0; x < w; x++ {
+			lum[y][x] = luminance(tile, b.Min.X+x, b.Min.Y+y)
+		}
+	}
+
+	row := func(y int) []float64 {
+		return lum[y]
+	}
+	col := func(x int) []float64 {
+		ret := make([]float64, h)
+		for y := range lum {
+			ret[y] = lum[y][x]
+		}
+		return ret
+	}
+
+	left = borderSize(w, func(i int) []float64 { return col(i) })
+	right = borderSize(w, func(i int) []float64 { return col(w - 1 - i) })
+	top = borderSize(h, func(i int) []float64 { return row(i) })
+	bottom = borderSize(h, func(i int) []float64 { return row(h - 1 - i) })
+	return
+}
+
+// borderSize returns the number of uniform lines of similar luminance from the
+// edge of a tile. line returns the luminance of the pixels of the line at the
+// provided distance from the edge.
+func borderSize(lines int, line func(i int) []float64) int {
+	max := int(float64(lines) * maxBorderFraction)
+
+	var edgeMean float64
+	for i := 0; i < max; i++ {
+		mean, stdDev := meanStdDev(line(i))
+		if i == 0 {
+			edgeMean = mean
+		}
+
+		if stdDev > borderTolerance || math.Abs(mean-edgeMean) > borderTolerance {
+			return i
+		}
+	}
+
+	return max
+}
+
+func meanStdDev(values []float64) (float64, float64) {
+	if len(values) == 0 {
+		return 0, 0
+	}
+
+	var sum, sumSq float64
+	for _, v := range values {
+		sum += v
+		sumSq += v * v
+	}
+
+	n := float64(len(values))
+	mean := sum / n
+	return mean, math.Sqrt(math.Max(0, sumSq/n-mean*mean))
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+
+	return b
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+
+	return b
+}
+
+// mirrorTiles returns a copy of the sprite image with each tile mirrored
+// horizontally. The order of the tiles is unchanged.
+func mirrorTiles(img image.Image, cols, rows int) image.Image {
+	bounds := img.Bounds()
+	w := bounds.Dx() / cols
+	ret := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+
+	for y := 0; y < bounds.Dy(); y++ {
+		for x := 0; x < bounds.Dx(); x++ {
+			// pixels beyond the last full tile are not mirrored
+			mx := x
+			if w > 0 && x < w*cols {
+				tile := x / w
+				mx = tile*w + (w - 1 - x%w)
+			}
+
+			ret.Set(x, y, img.At(bounds.Min.X+mx, bounds.Min.Y+y))
+		}
+	}
+
+	return ret
+}
+
+// tileHash returns a 64 bit difference hash of the luminance of the image.
+// Each bit is set if a pixel of an 8x8 version of the image is darker than
+// its right neighbour.
+func tileHash(img image.Image) uint64 {
+	scaled := resize.Resize(9, 8, img, resize.Bilinear)
+	bounds := scaled.Bounds()
+
+	var ret uint64
+	var bit uint
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			left := luminance(scaled, bounds.Min.X+x, bounds.Min.Y+y)
+			right := luminance(scaled, bounds.Min.X+x+1, bounds.Min.Y+y)
+			if left < right {
+				ret |= 1 << bit
+			}
+			bit++
+		}
+	}
+
+	return ret
+}
+
+// luminance returns the luminance of the pixel, between 0 and 65535.
+func luminance(img image.Image, x, y int) float64 {
+	r, g, b, _ := img.At(x, y).RGBA()
+	return 0.299*float64(r) + 0.587*float64(g) + 0.114*float64(b)
+}
+
+func hammingDistance(a, b uint64) int {
+	return bits.OnesCount64(a ^ b)
+}
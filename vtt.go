@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const vttSuffix = "_thumbs.vtt"
+
+// vttCue is the time range of a sprite tile, in seconds.
+type vttCue struct {
+	start float64
+	end   float64
+}
+
+// spriteVTT contains the cue of each tile of a sprite, in row order. Tiles
+// without a cue have a nil entry.
+type spriteVTT []*vttCue
+
+func getVTTFilename(path, checksum string) string {
+	return filepath.Join(path, checksum+vttSuffix)
+}
+
+// readVTT reads the VTT file generated by stash alongside a sprite. Each cue
+// contains the time range and the sprite coordinates of a tile, in the form:
+//
+//	00:00:20.000 --> 00:00:40.000
+//	<checksum>_sprite.jpg#xywh=160,0,160,90
+func readVTT(fn string) (spriteVTT, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	ret := make(spriteVTT, spriteGridSize*spriteGridSize)
+	var cue *vttCue
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		switch {
+		case strings.Contains(text, "-->"):
+			cue, err = parseVTTTiming(text)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %s", line, err.Error())
+			}
+		case cue != nil && strings.Contains(text, "#xywh="):
+			i, err := parseVTTTile(text)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %s", line, err.Error())
+			}
+			if i < len(ret) {
+				ret[i] = cue
+			}
+			cue = nil
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return ret, nil
+}
+
+// duration returns the end time of the last cue, which is the duration of
+// the scene, or 0 if there are no cues.
+func (v spriteVTT) duration() float64 {
+	ret := 0.0
+	for _, c := range v {
+		if c != nil && c.end > ret {
+			ret = c.end
+		}
+	}
+
+	return ret
+}
+
+func parseVTTTiming(text string) (*vttCue, error) {
+	parts := strings.SplitN(text, "-->", 2)
+	start, err := parseVTTTime(parts[0])
+	if err != nil {
+		return nil, err
+	}
+
+	// cue settings may follow the end time
+	fields := strings.Fields(parts[1])
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("invalid timing %q", text)
+	}
+
+	end, err := parseVTTTime(fields[0])
+	if err != nil {
+		return nil, err
+	}
+
+	return &vttCue{start: start, end: end}, nil
+}
+
+// parseVTTTime parses a time in the form [hh:]mm:ss.ttt, returning the time
+// in seconds.
+func parseVTTTime(text string) (float64, error) {
+	parts := strings.Split(strings.TrimSpace(text), ":")
+	if len(parts) < 2 || len(parts) > 3 {
+		return 0, fmt.Errorf("invalid time %q", text)
+	}
+
+	ret := 0.0
+	for _, p := range parts {
+		v, err := strconv.ParseFloat(p, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid time %q", text)
+		}
+		ret = ret*60 + v
+	}
+
+	return ret, nil
+}
+
+// parseVTTTile returns the index of the tile from the sprite coordinates of
+// a cue.
+func parseVTTTile(text string) (int, error) {
+	coords := strings.Split(text[strings.Index(text, "#xywh=")+len("#xywh="):], ",")
+	if len(coords) != 4 {
+		return 0, fmt.Errorf("invalid coordinates %q", text)
+	}
+
+	var v [4]int
+	for i, c := range coords {
+		n, err := strconv.Atoi(strings.TrimSpace(c))
+		if err != nil {
+			return 0, fmt.Errorf("invalid coordinates %q", text)
+		}
+		v[i] = n
+	}
+
+	x, y, w, h := v[0], v[1], v[2], v[3]
+	if w <= 0 || h <= 0 {
+		return 0, fmt.Errorf("invalid coordinates %q", text)
+	}
+
+	return (y/h)*spriteGridSize + x/w, nil
+}
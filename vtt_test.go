@@ -0,0 +1,271 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseVTTTime(t *testing.T) {
+	tests := []struct {
+		text    string
+		want    float64
+		wantErr bool
+	}{
+		{"00:00:20.000", 20, false},
+		{"01:02:03.500", 3723.5, false},
+		{"02:03.250", 123.25, false},
+		{" 00:01.000 ", 1, false},
+		{"20.000", 0, true},
+		{"00:00:00:20.000", 0, true},
+		{"00:xx:20.000", 0, true},
+		{"", 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.text, func(t *testing.T) {
+			got, err := parseVTTTime(tt.text)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseVTTTime(%q) error = %v, wantErr %v", tt.text, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("parseVTTTime(%q) = %v, want %v", tt.text, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseVTTTiming(t *testing.T) {
+	tests := []struct {
+		name    string
+		text    string
+		want    vttCue
+		wantErr bool
+	}{
+		{"hours", "00:00:20.000 --> 00:00:40.000", vttCue{20, 40}, false},
+		{"no hours", "00:20.000 --> 00:40.000", vttCue{20, 40}, false},
+		{"mixed", "59:50.000 --> 01:00:10.000", vttCue{3590, 3610}, false},
+		{"cue settings", "00:00:20.000 --> 00:00:40.000 line:0 align:start", vttCue{20, 40}, false},
+		{"no spaces", "00:20.000-->00:40.000", vttCue{20, 40}, false},
+		{"missing end", "00:00:20.000 --> ", vttCue{}, true},
+		{"invalid start", "xx --> 00:00:40.000", vttCue{}, true},
+		{"invalid end", "00:00:20.000 --> xx", vttCue{}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseVTTTiming(tt.text)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseVTTTiming(%q) error = %v, wantErr %v", tt.text, err, tt.wantErr)
+			}
+			if err == nil && *got != tt.want {
+				t.Errorf("parseVTTTiming(%q) = %v, want %v", tt.text, *got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseVTTTile(t *testing.T) {
+	tests := []struct {
+		name    string
+		text    string
+		want    int
+		wantErr bool
+	}{
+		{"first", "abc_sprite.jpg#xywh=0,0,160,90", 0, false},
+		{"second column", "abc_sprite.jpg#xywh=160,0,160,90", 1, false},
+		{"second row", "abc_sprite.jpg#xywh=0,90,160,90", 9, false},
+		{"last", "abc_sprite.jpg#xywh=1280,720,160,90", 80, false},
+		{"portrait tiles", "abc_sprite.jpg#xywh=180,640,90,160", 38, false},
+		{"spaces", "abc_sprite.jpg#xywh=160, 90, 160, 90", 10, false},
+		{"too few coordinates", "abc_sprite.jpg#xywh=0,0,160", 0, true},
+		{"not a number", "abc_sprite.jpg#xywh=0,a,160,90", 0, true},
+		{"zero width", "abc_sprite.jpg#xywh=0,0,0,90", 0, true},
+		{"zero height", "abc_sprite.jpg#xywh=0,0,160,0", 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseVTTTile(tt.text)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseVTTTile(%q) error = %v, wantErr %v", tt.text, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("parseVTTTile(%q) = %d, want %d", tt.text, got, tt.want)
+			}
+		})
+	}
+}
+
+func writeTestVTT(t *testing.T, dir, name string, lines ...string) string {
+	fn := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(fn, []byte(strings.Join(lines, "\n")), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	return fn
+}
+
+func TestReadVTT(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vtt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name         string
+		lines        []string
+		want         map[int]vttCue
+		wantDuration float64
+		wantErr      bool
+	}{
+		{
+			name: "stash format",
+			lines: []string{
+				"WEBVTT",
+				"",
+				"00:00:00.000 --> 00:00:20.000",
+				"abc_sprite.jpg#xywh=0,0,160,90",
+				"",
+				"00:00:20.000 --> 00:00:40.000",
+				"abc_sprite.jpg#xywh=160,0,160,90",
+				"",
+			},
+			want:         map[int]vttCue{0: {0, 20}, 1: {20, 40}},
+			wantDuration: 40,
+		},
+		{
+			name: "cue identifiers and settings",
+			lines: []string{
+				"WEBVTT",
+				"",
+				"1",
+				"00:00.000 --> 00:20.000 align:start",
+				"abc_sprite.jpg#xywh=0,0,160,90",
+				"",
+				"2",
+				"00:20.000 --> 00:40.000 align:start",
+				"abc_sprite.jpg#xywh=160,0,160,90",
+			},
+			want:         map[int]vttCue{0: {0, 20}, 1: {20, 40}},
+			wantDuration: 40,
+		},
+		{
+			name: "hours and unequal durations",
+			lines: []string{
+				"WEBVTT",
+				"",
+				"00:59:00.000 --> 01:00:00.000",
+				"abc_sprite.jpg#xywh=0,0,160,90",
+				"",
+				"01:00:00.000 --> 01:00:05.500",
+				"abc_sprite.jpg#xywh=160,0,160,90",
+			},
+			want:         map[int]vttCue{0: {3540, 3600}, 1: {3600, 3605.5}},
+			wantDuration: 3605.5,
+		},
+		{
+			name: "gaps",
+			lines: []string{
+				"WEBVTT",
+				"",
+				"00:00:00.000 --> 00:00:20.000",
+				"abc_sprite.jpg#xywh=0,0,160,90",
+				"",
+				"00:02:00.000 --> 00:02:20.000",
+				"abc_sprite.jpg#xywh=0,90,160,90",
+				"",
+				"00:00:40.000 --> 00:01:00.000",
+				"",
+				"00:26:40.000 --> 00:27:00.000",
+				"abc_sprite.jpg#xywh=1280,720,160,90",
+			},
+			want:         map[int]vttCue{0: {0, 20}, 9: {120, 140}, 80: {1600, 1620}},
+			wantDuration: 1620,
+		},
+		{
+			name: "tiles outside the grid",
+			lines: []string{
+				"WEBVTT",
+				"",
+				"00:00:00.000 --> 00:00:20.000",
+				"abc_sprite.jpg#xywh=0,900,160,90",
+			},
+			want: map[int]vttCue{},
+		},
+		{
+			name: "coordinates without a cue",
+			lines: []string{
+				"WEBVTT",
+				"",
+				"abc_sprite.jpg#xywh=0,0,160,90",
+			},
+			want: map[int]vttCue{},
+		},
+		{
+			name:  "empty",
+			lines: []string{"WEBVTT"},
+			want:  map[int]vttCue{},
+		},
+		{
+			name: "invalid timing",
+			lines: []string{
+				"WEBVTT",
+				"",
+				"00:00:xx --> 00:00:20.000",
+				"abc_sprite.jpg#xywh=0,0,160,90",
+			},
+			wantErr: true,
+		},
+		{
+			name: "invalid coordinates",
+			lines: []string{
+				"WEBVTT",
+				"",
+				"00:00:00.000 --> 00:00:20.000",
+				"abc_sprite.jpg#xywh=0,0,0,0",
+			},
+			wantErr: true,
+		},
+	}
+
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fn := writeTestVTT(t, dir, strings.Repeat("x", i+1)+vttSuffix, tt.lines...)
+			got, err := readVTT(fn)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("readVTT() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+
+			if len(got) != spriteGridSize*spriteGridSize {
+				t.Fatalf("len(readVTT()) = %d, want %d", len(got), spriteGridSize*spriteGridSize)
+			}
+
+			for i, c := range got {
+				want, found := tt.want[i]
+				switch {
+				case found && c == nil:
+					t.Errorf("tile %d has no cue, want %v", i, want)
+				case !found && c != nil:
+					t.Errorf("tile %d cue = %v, want none", i, *c)
+				case found && *c != want:
+					t.Errorf("tile %d cue = %v, want %v", i, *c, want)
+				}
+			}
+
+			if d := got.duration(); d != tt.wantDuration {
+				t.Errorf("duration() = %v, want %v", d, tt.wantDuration)
+			}
+		})
+	}
+
+	if _, err := readVTT(filepath.Join(dir, "missing"+vttSuffix)); err == nil {
+		t.Error("readVTT() of a missing file returned no error")
+	}
+}